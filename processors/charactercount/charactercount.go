@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -10,16 +11,28 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
 )
 
 type configuration struct {
 	natsServer  string
 	natsToken   string
 	natsSubject string
+	patterns    map[string]countPattern // Keys are routers (gl_path) or "default"
 }
 
 var config configuration = configuration{
 	natsSubject: "coburn.gl.charactercount",
+	patterns: map[string]countPattern{
+		"default": {
+			// https://github.com/tidwall/gjson/blob/master/SYNTAX.md
+			Messages: "ingress_payload.messages",
+			Role:     "role",
+			Content:  "content",
+			Prompt:   "ingress_payload.prompt",
+			System:   "ingress_payload.system",
+		},
+	},
 }
 
 // ------------------------------- DO --------------------------------
@@ -73,14 +86,34 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 			}
 
 			// Process the data
-			ingressPayload, ok := inputData["ingress_payload"]
-			if !ok {
+			if _, ok := inputData["ingress_payload"]; !ok {
 				slog.Error("ingress_payload not found")
 				return
 			}
 
+			// Figure out what router (gl_path) we are using
+			glPath := gjson.GetBytes(msg.Data, "gl_path").String()
+			pattern, exists := config.patterns[glPath]
+			if !exists {
+				// Use default if it exists
+				pattern, exists = config.patterns["default"]
+			}
+			if !exists {
+				slog.Debug("noop: gl_path not found")
+				return
+			}
+
+			// Count the message text, not the json around it
+			total := countPrompt(msg.Data, pattern)
+			totalBytes, err := json.Marshal(&total)
+			if err != nil {
+				slog.Error("error marshalling counts", slog.Any("error", err))
+				return
+			}
+
 			var outputData = make(map[string]json.RawMessage)
-			outputData["character_count"] = []byte(strconv.Itoa(len(ingressPayload)))
+			outputData["character_count"] = []byte(strconv.Itoa(total.Runes))
+			outputData["text_counts"] = totalBytes
 
 			// Prepare response
 			responseBytes, err = json.Marshal(&outputData)
@@ -104,6 +137,32 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 	<-ctx.Done()
 }
 
+// Read the patterns from a json file like {"patterns": {"default": {"messages": ..., "role": ..., "content": ..., "prompt": ..., "system": ...}}}
+func loadPatterns(path string) (map[string]countPattern, error) {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Patterns map[string]countPattern `json:"patterns"`
+	}
+	if err := json.Unmarshal(fileBytes, &file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if len(file.Patterns) == 0 {
+		return nil, fmt.Errorf("no patterns in %s", path)
+	}
+	for router, pattern := range file.Patterns {
+		if pattern.Messages == "" && pattern.Prompt == "" {
+			return nil, fmt.Errorf("router %s: needs messages or prompt", router)
+		}
+		if pattern.Messages != "" && pattern.Content == "" {
+			return nil, fmt.Errorf("router %s: messages needs content", router)
+		}
+	}
+	return file.Patterns, nil
+}
+
 // ------------------------------- MAIN --------------------------------
 
 // Set up possible configs, logger, context & cancel, capture ctrl-C and call do()
@@ -119,6 +178,17 @@ func main() {
 	config.natsServer = "nats://" + glHost + ":4222"
 	config.natsToken = os.Getenv("NATS_TOKEN")
 
+	// Optional json file replacing the built-in patterns
+	if patternsFile := os.Getenv("PATTERNS_FILE"); patternsFile != "" {
+		patterns, err := loadPatterns(patternsFile)
+		if err != nil {
+			slog.Error("error loading patterns", slog.String("file", patternsFile), slog.Any("error", err))
+			return
+		}
+		config.patterns = patterns
+		slog.Info("patterns loaded", slog.String("file", patternsFile), slog.Int("routers", len(patterns)))
+	}
+
 	// Create context & sync
 	ctx, cancelFunction := context.WithCancel(context.Background())
 	defer cancelFunction()
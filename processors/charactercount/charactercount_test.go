@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{"valid", `{"patterns":{"default":{"messages":"ingress_payload.messages","role":"role","content":"content"},"/completions/":{"prompt":"ingress_payload.prompt"}}}`, ""},
+		{"with system", `{"patterns":{"/anthropic/":{"messages":"ingress_payload.messages","role":"role","content":"content","system":"ingress_payload.system"}}}`, ""},
+		{"no patterns", `{"patterns":{}}`, "no patterns"},
+		{"no messages or prompt", `{"patterns":{"default":{"role":"role"}}}`, "needs messages or prompt"},
+		{"messages without content", `{"patterns":{"default":{"messages":"ingress_payload.messages"}}}`, "messages needs content"},
+		{"invalid json", `{"patterns":`, "error parsing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "patterns.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			patterns, err := loadPatterns(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(patterns) == 0 {
+					t.Error("no patterns loaded")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := loadPatterns(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+	"github.com/tidwall/gjson"
+)
+
+// Counts of the prompt text, each metric separately
+type counts struct {
+	Bytes     int `json:"bytes"`     // UTF-8 bytes of the text, not of the json
+	Runes     int `json:"runes"`     // Unicode code points
+	Graphemes int `json:"graphemes"` // User-perceived characters, like an emoji with modifiers
+	Words     int `json:"words"`     // Unicode word boundaries (UAX #29), punctuation is not a word
+	Lines     int `json:"lines"`     // A trailing newline does not start a new line
+}
+
+func (c *counts) add(other counts) {
+	c.Bytes += other.Bytes
+	c.Runes += other.Runes
+	c.Graphemes += other.Graphemes
+	c.Words += other.Words
+	c.Lines += other.Lines
+}
+
+func countText(text string) counts {
+	c := counts{
+		Bytes:     len(text),
+		Runes:     utf8.RuneCountInString(text),
+		Graphemes: uniseg.GraphemeClusterCount(text),
+	}
+
+	state := -1
+	for rest := text; len(rest) > 0; {
+		var word string
+		word, rest, state = uniseg.FirstWordInString(rest, state)
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			c.Words++
+		}
+	}
+
+	if text != "" {
+		c.Lines = strings.Count(text, "\n")
+		if !strings.HasSuffix(text, "\n") {
+			c.Lines++
+		}
+	}
+	return c
+}
+
+// The text of a message content. Content is a string, or an array of parts
+// where only the text parts count, like [{"type":"text","text":"..."},{"type":"image_url",...}]
+func contentTexts(content gjson.Result) []string {
+	switch {
+	case content.Type == gjson.String:
+		return []string{content.String()}
+	case content.IsArray():
+		texts := []string{}
+		for _, part := range content.Array() {
+			if part.Type == gjson.String {
+				texts = append(texts, part.String())
+				continue
+			}
+			if text := part.Get("text"); text.Type == gjson.String {
+				texts = append(texts, text.String())
+			}
+		}
+		return texts
+	}
+	return []string{}
+}
+
+// Where the prompt text is, per router. Paths are gjson paths: https://github.com/tidwall/gjson/blob/master/SYNTAX.md
+type countPattern struct {
+	Messages string `json:"messages"` // Array of messages in the gecholog message
+	Role     string `json:"role"`     // Role in a message
+	Content  string `json:"content"`  // Content in a message, a string or an array of parts
+	Prompt   string `json:"prompt"`   // Text used when there are no messages, like a completions prompt
+	System   string `json:"system"`   // Optional system prompt outside the messages, like in Anthropic requests
+}
+
+// Counts of one message
+type messageCounts struct {
+	Index int    `json:"index"`
+	Role  string `json:"role"`
+	counts
+}
+
+// Totals with the breakdown per role and per message
+type textCounts struct {
+	counts
+	ByRole   map[string]counts `json:"by_role"`
+	Messages []messageCounts   `json:"messages"`
+}
+
+// Count the prompt text of a gecholog message
+func countPrompt(data []byte, pattern countPattern) textCounts {
+	result := textCounts{ByRole: map[string]counts{}, Messages: []messageCounts{}}
+
+	// A system prompt outside the messages counts as role system, it is not a message
+	if pattern.System != "" {
+		if system := gjson.GetBytes(data, pattern.System); system.Exists() {
+			var systemCounts counts
+			for _, text := range contentTexts(system) {
+				systemCounts.add(countText(text))
+			}
+			result.ByRole["system"] = systemCounts
+			result.add(systemCounts)
+		}
+	}
+
+	messages := gjson.GetBytes(data, pattern.Messages)
+	if pattern.Messages == "" || !messages.IsArray() {
+		// No messages, count the prompt
+		if pattern.Prompt != "" {
+			for _, text := range contentTexts(gjson.GetBytes(data, pattern.Prompt)) {
+				result.add(countText(text))
+			}
+		}
+		return result
+	}
+
+	for i, message := range messages.Array() {
+		role := message.Get(pattern.Role).String()
+		if role == "" {
+			role = "unknown"
+		}
+
+		m := messageCounts{Index: i, Role: role}
+		for _, text := range contentTexts(message.Get(pattern.Content)) {
+			m.add(countText(text))
+		}
+		result.Messages = append(result.Messages, m)
+
+		roleCounts := result.ByRole[role]
+		roleCounts.add(m.counts)
+		result.ByRole[role] = roleCounts
+		result.add(m.counts)
+	}
+	return result
+}
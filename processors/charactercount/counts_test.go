@@ -0,0 +1,162 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestCountText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want counts
+	}{
+		{"empty", "", counts{}},
+		{"ascii", "Who were the founders of Microsoft?", counts{Bytes: 35, Runes: 35, Graphemes: 35, Words: 6, Lines: 1}},
+		{"multibyte", "häll", counts{Bytes: 5, Runes: 4, Graphemes: 4, Words: 1, Lines: 1}},
+		{"emoji with modifier", "👍🏽", counts{Bytes: 8, Runes: 2, Graphemes: 1, Words: 0, Lines: 1}},
+		{"combining mark", "é", counts{Bytes: 3, Runes: 2, Graphemes: 1, Words: 1, Lines: 1}},
+		{"punctuation is not a word", "Hello, world! ...", counts{Bytes: 17, Runes: 17, Graphemes: 17, Words: 2, Lines: 1}},
+		{"contractions and numbers", "don't pay 3.14", counts{Bytes: 14, Runes: 14, Graphemes: 14, Words: 3, Lines: 1}},
+		{"cjk characters are words", "你好世界", counts{Bytes: 12, Runes: 4, Graphemes: 4, Words: 4, Lines: 1}},
+		{"lines", "one\ntwo", counts{Bytes: 7, Runes: 7, Graphemes: 7, Words: 2, Lines: 2}},
+		{"trailing newline", "one\ntwo\n", counts{Bytes: 8, Runes: 8, Graphemes: 8, Words: 2, Lines: 2}},
+		{"only a newline", "\n", counts{Bytes: 1, Runes: 1, Graphemes: 1, Words: 0, Lines: 1}},
+		{"crlf", "one\r\ntwo", counts{Bytes: 8, Runes: 8, Graphemes: 7, Words: 2, Lines: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countText(tt.text); got != tt.want {
+				t.Errorf("countText(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTexts(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"string", `"hello"`, []string{"hello"}},
+		{"empty string", `""`, []string{""}},
+		{"text parts", `[{"type":"text","text":"one"},{"type":"text","text":"two"}]`, []string{"one", "two"}},
+		{"skips image parts", `[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBOR"}}]`, []string{"what is this?"}},
+		{"string parts", `["one","two"]`, []string{"one", "two"}},
+		{"null", `null`, []string{}},
+		{"number", `42`, []string{}},
+		{"object", `{"text":"not a part"}`, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentTexts(gjson.Parse(tt.content)); !slices.Equal(got, tt.want) {
+				t.Errorf("contentTexts(%s) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountPrompt(t *testing.T) {
+	pattern := config.patterns["default"]
+	system := countText("You are terse.")
+	user := countText("Who were the founders of Microsoft?")
+	assistant := countText("Bill Gates and Paul Allen.")
+	sum := func(c ...counts) counts {
+		var total counts
+		for _, one := range c {
+			total.add(one)
+		}
+		return total
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		total    counts
+		byRole   map[string]counts
+		messages []messageCounts
+	}{
+		{
+			name:   "chat messages",
+			data:   `{"ingress_payload":{"messages":[{"role":"system","content":"You are terse."},{"role":"user","content":"Who were the founders of Microsoft?"},{"role":"assistant","content":"Bill Gates and Paul Allen."},{"role":"user","content":"Who were the founders of Microsoft?"}]}}`,
+			total:  sum(system, user, assistant, user),
+			byRole: map[string]counts{"system": system, "user": sum(user, user), "assistant": assistant},
+			messages: []messageCounts{
+				{Index: 0, Role: "system", counts: system},
+				{Index: 1, Role: "user", counts: user},
+				{Index: 2, Role: "assistant", counts: assistant},
+				{Index: 3, Role: "user", counts: user},
+			},
+		},
+		{
+			name:     "missing role and multi-part content",
+			data:     `{"ingress_payload":{"messages":[{"content":[{"type":"text","text":"Who were the founders of Microsoft?"},{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]},{"role":"tool","content":null}]}}`,
+			total:    user,
+			byRole:   map[string]counts{"unknown": user, "tool": {}},
+			messages: []messageCounts{{Index: 0, Role: "unknown", counts: user}, {Index: 1, Role: "tool"}},
+		},
+		{
+			name:     "anthropic top-level system",
+			data:     `{"ingress_payload":{"system":"You are terse.","messages":[{"role":"user","content":"Who were the founders of Microsoft?"}]}}`,
+			total:    sum(system, user),
+			byRole:   map[string]counts{"system": system, "user": user},
+			messages: []messageCounts{{Index: 0, Role: "user", counts: user}},
+		},
+		{
+			name:     "anthropic system blocks and system messages add up",
+			data:     `{"ingress_payload":{"system":[{"type":"text","text":"You are terse."}],"messages":[{"role":"system","content":"You are terse."}]}}`,
+			total:    sum(system, system),
+			byRole:   map[string]counts{"system": sum(system, system)},
+			messages: []messageCounts{{Index: 0, Role: "system", counts: system}},
+		},
+		{
+			name:     "completions prompt",
+			data:     `{"ingress_payload":{"prompt":"Who were the founders of Microsoft?"}}`,
+			total:    user,
+			byRole:   map[string]counts{},
+			messages: []messageCounts{},
+		},
+		{
+			name:     "prompt array",
+			data:     `{"ingress_payload":{"prompt":["Who were the founders of Microsoft?","Bill Gates and Paul Allen."]}}`,
+			total:    sum(user, assistant),
+			byRole:   map[string]counts{},
+			messages: []messageCounts{},
+		},
+		{
+			name:     "nothing to count",
+			data:     `{"ingress_payload":{"input":"embeddings"}}`,
+			byRole:   map[string]counts{},
+			messages: []messageCounts{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := countPrompt([]byte(tt.data), pattern)
+			if got.counts != tt.total {
+				t.Errorf("total = %+v, want %+v", got.counts, tt.total)
+			}
+			if !maps.Equal(got.ByRole, tt.byRole) {
+				t.Errorf("by_role = %+v, want %+v", got.ByRole, tt.byRole)
+			}
+			if !slices.Equal(got.Messages, tt.messages) {
+				t.Errorf("messages = %+v, want %+v", got.Messages, tt.messages)
+			}
+		})
+	}
+}
+
+// Routers can have their own paths, like a message array with other names
+func TestCountPromptPattern(t *testing.T) {
+	pattern := countPattern{Messages: "ingress_payload.contents", Role: "author", Content: "parts"}
+	got := countPrompt([]byte(`{"ingress_payload":{"contents":[{"author":"user","parts":["hi","there"]}],"prompt":"not used"}}`), pattern)
+	want := countText("hi")
+	want.add(countText("there"))
+	if got.ByRole["user"] != want || got.counts != want {
+		t.Errorf("got %+v, want user and total %+v", got, want)
+	}
+}
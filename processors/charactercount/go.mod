@@ -1,13 +1,19 @@
 module charactercount
 
-go 1.21.5
+go 1.22.0
 
-require github.com/nats-io/nats.go v1.32.0
+require (
+	github.com/nats-io/nats.go v1.32.0
+	github.com/rivo/uniseg v0.4.7
+	github.com/tidwall/gjson v1.17.0
+)
 
 require (
 	github.com/klauspost/compress v1.17.2 // indirect
 	github.com/nats-io/nkeys v0.4.7 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/tidwall/match v1.1.1 // indirect
+	github.com/tidwall/pretty v1.2.0 // indirect
 	golang.org/x/crypto v0.18.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
 )
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Admin actions on the recordings
+const (
+	adminList     = "list"
+	adminGet      = "get"
+	adminPut      = "put"
+	adminDelete   = "delete"
+	adminFreeze   = "freeze"
+	adminUnfreeze = "unfreeze"
+	adminClear    = "clear"
+)
+
+// Admin request message
+type adminRequest struct {
+	Action           string          `json:"action"`
+	Namespace        string          `json:"namespace"` // empty is the shared namespace
+	GlPath           string          `json:"gl_path"`   // empty means all recordings for freeze & unfreeze
+	EgressPayload    json.RawMessage `json:"egress_payload"`
+	EgressHeaders    json.RawMessage `json:"egress_headers"`
+	EgressStatusCode json.RawMessage `json:"egress_status_code"`
+	Templated        bool            `json:"templated"` // Render placeholders in the payload and headers on replay
+}
+
+// A recording as returned by the admin interface
+type recordingInfo struct {
+	Namespace        string          `json:"namespace"`
+	GlPath           string          `json:"gl_path"`
+	EgressPayload    json.RawMessage `json:"egress_payload,omitempty"`
+	EgressHeaders    json.RawMessage `json:"egress_headers,omitempty"`
+	EgressStatusCode json.RawMessage `json:"egress_status_code"`
+	Stream           bool            `json:"stream"`
+	Chunks           int             `json:"chunks"`
+	Templated        bool            `json:"templated"`
+	Frozen           bool            `json:"frozen"`
+	RecordedAt       time.Time       `json:"recorded_at"`
+}
+
+// Admin response message
+type adminResponse struct {
+	OK              bool            `json:"ok"`
+	Error           string          `json:"error,omitempty"`
+	RecordingFrozen bool            `json:"recording_frozen"`
+	Recordings      []recordingInfo `json:"recordings"`
+}
+
+func newRecordingInfo(r router, full bool) recordingInfo {
+	info := recordingInfo{
+		Namespace:        r.namespace,
+		GlPath:           r.glPath,
+		EgressStatusCode: r.responseStatusCode,
+		Stream:           len(r.chunks) > 0,
+		Chunks:           len(r.chunks),
+		Templated:        r.templated,
+		Frozen:           r.frozen,
+		RecordedAt:       r.recordedAt,
+	}
+	if full {
+		info.EgressPayload = r.responsePayload
+		info.EgressHeaders = r.responseHeaders
+	}
+	return info
+}
+
+// Handle a message on the admin subject and return the reply
+func handleAdmin(data []byte) []byte {
+
+	response := adminResponse{Recordings: []recordingInfo{}}
+	err := func() error {
+		var request adminRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			return fmt.Errorf("invalid request: %w", err)
+		}
+
+		key := recordingKey{namespace: request.Namespace, glPath: request.GlPath}
+
+		config.m.Lock() // mutex lock since maps are not thread safe for writing
+		defer config.m.Unlock()
+
+		switch request.Action {
+		case adminList:
+			for _, r := range config.recordedRouters {
+				response.Recordings = append(response.Recordings, newRecordingInfo(r, false))
+			}
+			slices.SortFunc(response.Recordings, func(a, b recordingInfo) int {
+				return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.GlPath, b.GlPath))
+			})
+
+		case adminGet:
+			r, exists := config.recordedRouters[key]
+			if !exists {
+				return fmt.Errorf("no recording for gl_path %q", request.GlPath)
+			}
+			response.Recordings = append(response.Recordings, newRecordingInfo(r, true))
+
+		case adminPut:
+			if request.GlPath == "" {
+				return fmt.Errorf("gl_path is required")
+			}
+			for field, value := range map[string]json.RawMessage{
+				"egress_payload":     request.EgressPayload,
+				"egress_headers":     request.EgressHeaders,
+				"egress_status_code": request.EgressStatusCode,
+			} {
+				if len(value) == 0 || !json.Valid(value) {
+					return fmt.Errorf("%s is required and must be valid json", field)
+				}
+			}
+			r := newRecording(
+				request.Namespace,
+				request.GlPath,
+				gjson.ParseBytes(request.EgressPayload),
+				gjson.ParseBytes(request.EgressHeaders),
+				gjson.ParseBytes(request.EgressStatusCode),
+				0,
+			)
+			r.templated = request.Templated
+			r.frozen = config.recordedRouters[key].frozen // Keep the freeze
+			config.recordedRouters[key] = r
+			response.Recordings = append(response.Recordings, newRecordingInfo(r, false))
+
+		case adminDelete:
+			if _, exists := config.recordedRouters[key]; !exists {
+				return fmt.Errorf("no recording for gl_path %q", request.GlPath)
+			}
+			delete(config.recordedRouters, key)
+
+		case adminFreeze, adminUnfreeze:
+			frozen := request.Action == adminFreeze
+			if request.GlPath == "" {
+				config.recordingFrozen = frozen
+				break
+			}
+			r, exists := config.recordedRouters[key]
+			if !exists {
+				return fmt.Errorf("no recording for gl_path %q", request.GlPath)
+			}
+			r.frozen = frozen
+			config.recordedRouters[key] = r
+			response.Recordings = append(response.Recordings, newRecordingInfo(r, false))
+
+		case adminClear:
+			clear(config.recordedRouters)
+
+		default:
+			return fmt.Errorf("unknown action %q", request.Action)
+		}
+
+		response.RecordingFrozen = config.recordingFrozen
+		return nil
+	}()
+
+	response.OK = err == nil
+	if err != nil {
+		slog.Warn("admin request failed", slog.Any("error", err))
+		response.Error = err.Error()
+	}
+
+	responseBytes, err := json.Marshal(&response)
+	if err != nil {
+		slog.Error("error marshalling admin response", slog.Any("error", err))
+		return []byte{}
+	}
+	return responseBytes
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// Fault names. Also the accepted values of the fault header
+const (
+	faultNone        = ""
+	faultRateLimit   = "429"
+	faultServerError = "500"
+	faultUnavailable = "503"
+	faultTimeout     = "timeout"
+	faultMalformed   = "malformed"
+	faultTruncated   = "truncated"
+)
+
+// Probabilities (0-1) of injecting each fault for a mocked router
+type faultProfile struct {
+	RateLimit   float64 `json:"rate_limit"`
+	ServerError float64 `json:"server_error"`
+	Unavailable float64 `json:"unavailable"`
+	Timeout     float64 `json:"timeout"`
+	Malformed   float64 `json:"malformed"`
+	Truncated   float64 `json:"truncated"`
+
+	RetryAfter int `json:"retry_after"` // seconds, sent with 429 and 503
+}
+
+// Return the fault to inject, if any. The fault header on the request wins over the router probabilities
+func pickFault(data []byte, mockedPath string) string {
+
+	if f := headerValue(data, config.faultHeader); f != "" {
+		switch f {
+		case faultRateLimit, faultServerError, faultUnavailable, faultTimeout, faultMalformed, faultTruncated:
+			return f
+		}
+		slog.Warn("unknown fault in header", slog.String("fault", f))
+		return faultNone
+	}
+
+	profile, exists := lookupRouterSetting(config.faults, mockedPath)
+	if !exists {
+		return faultNone
+	}
+
+	// One draw, walk the cumulative probabilities
+	r := rand.Float64()
+	for _, candidate := range []struct {
+		fault       string
+		probability float64
+	}{
+		{faultRateLimit, profile.RateLimit},
+		{faultServerError, profile.ServerError},
+		{faultUnavailable, profile.Unavailable},
+		{faultTimeout, profile.Timeout},
+		{faultMalformed, profile.Malformed},
+		{faultTruncated, profile.Truncated},
+	} {
+		if r < candidate.probability {
+			return candidate.fault
+		}
+		r -= candidate.probability
+	}
+	return faultNone
+}
+
+// Build the gecholog fields for an error fault (429, 500, 503)
+func faultResponse(fault string, mockedPath string) map[string]json.RawMessage {
+
+	profile, _ := lookupRouterSetting(config.faults, mockedPath)
+	retryAfter := profile.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
+
+	headers := map[string][]string{
+		"Content-Type": {"application/json"},
+	}
+	message := "mock injected fault"
+	switch fault {
+	case faultRateLimit:
+		headers["Retry-After"] = []string{strconv.Itoa(retryAfter)}
+		message = "Rate limit is exceeded. Try again in " + strconv.Itoa(retryAfter) + " seconds."
+	case faultServerError:
+		message = "The server had an error while processing your request."
+	case faultUnavailable:
+		headers["Retry-After"] = []string{strconv.Itoa(retryAfter)}
+		message = "The service is temporarily unable to process your request."
+	}
+
+	payload, _ := json.Marshal(map[string]map[string]string{
+		"error": {
+			"code":    fault,
+			"message": message,
+		},
+	})
+	headersBytes, _ := json.Marshal(headers)
+
+	var gechologData = make(map[string]json.RawMessage, 3)
+	gechologData["egress_payload"] = payload
+	gechologData["egress_headers"] = headersBytes
+	gechologData["egress_status_code"] = json.RawMessage(strconv.Itoa(faultStatusCode(fault)))
+	return gechologData
+}
+
+func faultStatusCode(fault string) int {
+	switch fault {
+	case faultRateLimit:
+		return 429
+	case faultServerError:
+		return 500
+	case faultUnavailable:
+		return 503
+	}
+	return 200
+}
+
+// Corrupt a recorded payload. The result is sent as a json string since it is no longer valid json
+func corruptPayload(fault string, payload json.RawMessage) json.RawMessage {
+	text := string(payload)
+	if parsed := gjson.ParseBytes(payload); parsed.Type == gjson.String {
+		text = parsed.String() // event streams are already sent as a json string
+	}
+	var broken string
+	switch fault {
+	case faultMalformed:
+		broken = strings.Replace(text, ":", "", 1) + ",}"
+	case faultTruncated:
+		// Cut at a rune boundary, a split rune would be marshalled as U+FFFD
+		end := len(text) / 2
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		broken = text[:end]
+	default:
+		return payload
+	}
+	corrupted, _ := json.Marshal(broken)
+	return corrupted
+}
+
+// Case insensitive lookup of the first value of a header in ingress_headers
+func headerValue(data []byte, name string) string {
+	if name == "" {
+		return ""
+	}
+	value := ""
+	gjson.GetBytes(data, "ingress_headers").ForEach(func(key, values gjson.Result) bool {
+		if strings.EqualFold(key.String(), name) {
+			value = values.Get("0").String()
+			return false
+		}
+		return true
+	})
+	return value
+}
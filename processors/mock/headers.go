@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Which response headers are recorded. Header names are case insensitive and
+// a trailing * matches any suffix, like X-Ratelimit-*
+type headerScrubbing struct {
+	Allow       []string `json:"allow"`        // only record these headers, empty means all
+	Deny        []string `json:"deny"`         // never record these headers
+	Redact      []string `json:"redact"`       // record these headers with the value replaced
+	RedactValue string   `json:"redact_value"` // replacement value for redacted headers
+}
+
+// Defaults for the Azure OpenAI and OpenAI response headers
+var defaultHeaderScrubbing = headerScrubbing{
+	Allow: []string{},
+	Deny: []string{
+		"Set-Cookie",
+		"Date",
+		"Content-Length",
+		"X-Request-Id",
+		"Apim-Request-Id",
+		"X-Ms-Client-Request-Id",
+		"X-Ms-Region",
+		"Azureml-Model-Session",
+		"X-Ratelimit-*",
+		"Retry-After",
+		"Openai-Processing-Ms",
+		"X-Envoy-Upstream-Service-Time",
+		"Cf-Ray",
+		"Cf-Cache-Status",
+		"Strict-Transport-Security",
+		"Alt-Svc",
+	},
+	Redact: []string{
+		"Openai-Organization",
+		"Openai-Project",
+		"X-Ms-Deployment-Name",
+	},
+	RedactValue: "[redacted]",
+}
+
+func headerMatches(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+			return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+		}
+		return strings.EqualFold(name, pattern)
+	})
+}
+
+// Apply the allow, deny and redact lists to the recorded headers
+func (h headerScrubbing) scrub(headers gjson.Result) gjson.Result {
+	if !headers.IsObject() {
+		return headers
+	}
+
+	scrubbed := make(map[string]json.RawMessage)
+	headers.ForEach(func(key, values gjson.Result) bool {
+		name := key.String()
+		switch {
+		case len(h.Allow) > 0 && !headerMatches(h.Allow, name):
+		case headerMatches(h.Deny, name):
+		case headerMatches(h.Redact, name):
+			redacted := make([]string, len(values.Array()))
+			for i := range redacted {
+				redacted[i] = h.RedactValue
+			}
+			scrubbed[name], _ = json.Marshal(redacted)
+		default:
+			scrubbed[name] = json.RawMessage(values.Raw)
+		}
+		return true
+	})
+
+	scrubbedBytes, err := json.Marshal(scrubbed)
+	if err != nil {
+		return headers
+	}
+	return gjson.ParseBytes(scrubbedBytes)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Latency distributions
+const (
+	latencyNone        = "none"
+	latencyFixed       = "fixed"
+	latencyUniform     = "uniform"
+	latencyExponential = "exponential"
+	latencyLogNormal   = "lognormal"
+	latencyReplay      = "replay"
+)
+
+// How mock simulates response time. All times in milliseconds
+type latencyModel struct {
+	Model  string  `json:"model"`
+	MeanMs float64 `json:"mean_ms"` // fixed value, exponential mean, lognormal mean & replay fallback
+	Sigma  float64 `json:"sigma"`   // lognormal shape
+	MinMs  float64 `json:"min_ms"`  // lower cap, and lower bound for uniform
+	MaxMs  float64 `json:"max_ms"`  // upper cap if > 0, and upper bound for uniform
+
+	MsPerCompletionToken  float64 `json:"ms_per_completion_token"` // added per completion token of the recorded response
+	CompletionTokensField string  `json:"completion_tokens_field"` // gjson path in the recorded egress_payload
+	RecordedLatencyField  string  `json:"recorded_latency_field"`  // gjson path in the response context, used by replay
+}
+
+func (l latencyModel) validate() error {
+	switch l.Model {
+	case latencyNone, latencyFixed, latencyExponential, latencyReplay:
+	case latencyUniform:
+		if l.MaxMs < l.MinMs {
+			return fmt.Errorf("uniform latency needs max_ms >= min_ms")
+		}
+	case latencyLogNormal:
+		if l.MeanMs <= 0 {
+			return fmt.Errorf("lognormal latency needs mean_ms > 0")
+		}
+	default:
+		return fmt.Errorf("unknown latency model %q", l.Model)
+	}
+	if l.MinMs < 0 || l.MaxMs < 0 || l.MeanMs < 0 || l.MsPerCompletionToken < 0 {
+		return fmt.Errorf("latency values must not be negative")
+	}
+	if l.MaxMs > 0 && l.MaxMs < l.MinMs {
+		return fmt.Errorf("max_ms must be >= min_ms")
+	}
+	return nil
+}
+
+// Draw a response time for a recorded router
+func (l latencyModel) sample(recorded router) time.Duration {
+
+	var ms float64
+	switch l.Model {
+	case latencyFixed:
+		ms = l.MeanMs
+	case latencyUniform:
+		ms = l.MinMs + rand.Float64()*(l.MaxMs-l.MinMs)
+	case latencyExponential:
+		ms = rand.ExpFloat64() * l.MeanMs
+	case latencyLogNormal:
+		// Pick mu so that the distribution mean is MeanMs
+		mu := math.Log(l.MeanMs) - l.Sigma*l.Sigma/2
+		ms = math.Exp(mu + l.Sigma*rand.NormFloat64())
+	case latencyReplay:
+		ms = l.MeanMs
+		if recorded.latency > 0 {
+			ms = float64(recorded.latency) / float64(time.Millisecond)
+		}
+	default:
+		return 0
+	}
+
+	ms += l.MsPerCompletionToken * float64(recorded.completionTokens)
+
+	// Caps
+	if ms < l.MinMs {
+		ms = l.MinMs
+	}
+	if l.MaxMs > 0 && ms > l.MaxMs {
+		ms = l.MaxMs
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
-	"math/rand/v2"
 	"os"
 	"os/signal"
 	"strconv"
@@ -18,29 +18,263 @@ import (
 
 type router struct {
 	glPath             string
+	namespace          string
 	responsePayload    json.RawMessage
 	responseHeaders    json.RawMessage
 	responseStatusCode json.RawMessage
+
+	latency          time.Duration // Latency of the recorded response, used by the replay latency model
+	completionTokens int64
+
+	chunks     []json.RawMessage // Set if the recorded response was an event stream
+	events     []string          // Event name of each chunk
+	streamDone bool              // The recorded stream ended with data: [DONE]
+
+	templated bool // Render placeholders in the whole recording on replay, opt-in with the admin put
+
+	recordedAt time.Time
+	frozen     bool // Frozen recordings are not overwritten by real traffic
 }
 
 type configuration struct {
-	natsServer  string
-	natsToken   string
-	natsSubject string
+	natsServer   string
+	natsToken    string
+	natsSubject  string
+	adminSubject string
 
 	mockRouter      string
-	recordedRouters map[string]router
-	lambda          float64
+	recordedRouters map[recordingKey]router
+	recordingFrozen bool // Stop recording all routers
+	recordingRules  recordingRules
+	headerScrubbing headerScrubbing
+	namespace       namespaceSettings
+	latency         latencyModel
+
+	synthetic syntheticSettings
+	stream    streamSettings
+	templates map[string]templateSettings
+
+	faults       map[string]faultProfile
+	faultHeader  string
+	faultTimeout time.Duration
 
 	m *sync.Mutex
 }
 
 var config configuration = configuration{
 	natsSubject:     "coburn.gl.mock",
+	adminSubject:    "coburn.gl.mock.admin",
 	mockRouter:      "/mock/",
-	recordedRouters: make(map[string]router, 10), // Best practice to allocate memory for the map
-	lambda:          0,                           // default value
-	m:               &sync.Mutex{},
+	recordedRouters: make(map[recordingKey]router, 10), // Best practice to allocate memory for the map
+	namespace: namespaceSettings{
+		Source: namespaceNone,
+		Header: "Mock-Namespace",
+	},
+	headerScrubbing: defaultHeaderScrubbing,
+	latency: latencyModel{
+		Model:                 latencyNone, // default value
+		CompletionTokensField: "usage.completion_tokens",
+		RecordedLatencyField:  "outbound_inbound_timer.duration",
+	},
+	synthetic: syntheticSettings{
+		Enabled:          false,
+		Mode:             syntheticLorem,
+		DefaultMaxTokens: 16,
+		MaxTokens:        2048, // A stream of 2048 chunks stays well below the processor timeout
+		Model:            "mock",
+	},
+	stream: streamSettings{
+		FirstChunkMs:    0,
+		ChunkIntervalMs: 0,
+		WordsPerChunk:   1,
+	},
+	templates:    make(map[string]templateSettings),
+	faults:       make(map[string]faultProfile),
+	faultHeader:  "Mock-Fault",
+	faultTimeout: 110 * time.Second, // Beyond the 100000 ms processor timeout in gl_config.json
+	m:            &sync.Mutex{},
+}
+
+// Optional settings read from the file in MOCK_CONFIG
+type fileConfiguration struct {
+	Latency   *latencyModel      `json:"latency"`
+	Synthetic *syntheticSettings `json:"synthetic"`
+	Stream    *streamSettings    `json:"stream"`
+
+	Templates map[string]templateSettings `json:"templates"`
+
+	RecordingRules  *recordingRules  `json:"recording_rules"`
+	HeaderScrubbing *headerScrubbing `json:"header_scrubbing"`
+
+	Namespace *namespaceSettings `json:"namespace"`
+
+	Faults         map[string]faultProfile `json:"faults"`
+	FaultHeader    string                  `json:"fault_header"`
+	FaultTimeoutMs int                     `json:"fault_timeout_ms"`
+}
+
+func loadConfigFile(path string) error {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fileConfig fileConfiguration
+	if err := json.Unmarshal(fileBytes, &fileConfig); err != nil {
+		return err
+	}
+
+	if fileConfig.Latency != nil {
+		latency := *fileConfig.Latency
+		if latency.Model == "" {
+			latency.Model = latencyNone
+		}
+		if latency.CompletionTokensField == "" {
+			latency.CompletionTokensField = config.latency.CompletionTokensField
+		}
+		if latency.RecordedLatencyField == "" {
+			latency.RecordedLatencyField = config.latency.RecordedLatencyField
+		}
+		if err := latency.validate(); err != nil {
+			return err
+		}
+		config.latency = latency
+	}
+	if fileConfig.Synthetic != nil {
+		synthetic := *fileConfig.Synthetic
+		if synthetic.Mode == "" {
+			synthetic.Mode = config.synthetic.Mode
+		}
+		if synthetic.Mode != syntheticLorem && synthetic.Mode != syntheticEcho {
+			return fmt.Errorf("unknown synthetic mode %q", synthetic.Mode)
+		}
+		if synthetic.DefaultMaxTokens <= 0 {
+			synthetic.DefaultMaxTokens = config.synthetic.DefaultMaxTokens
+		}
+		if synthetic.MaxTokens <= 0 {
+			synthetic.MaxTokens = config.synthetic.MaxTokens
+		}
+		if synthetic.Model == "" {
+			synthetic.Model = config.synthetic.Model
+		}
+		config.synthetic = synthetic
+	}
+	if fileConfig.Stream != nil {
+		stream := *fileConfig.Stream
+		if stream.FirstChunkMs < 0 || stream.ChunkIntervalMs < 0 {
+			return fmt.Errorf("stream timing must not be negative")
+		}
+		if stream.WordsPerChunk <= 0 {
+			stream.WordsPerChunk = config.stream.WordsPerChunk
+		}
+		config.stream = stream
+	}
+	if fileConfig.RecordingRules != nil {
+		if err := fileConfig.RecordingRules.validate(); err != nil {
+			return err
+		}
+		config.recordingRules = *fileConfig.RecordingRules
+	}
+	if fileConfig.HeaderScrubbing != nil {
+		// Lists left out keep their defaults
+		scrubbing := *fileConfig.HeaderScrubbing
+		if scrubbing.Allow == nil {
+			scrubbing.Allow = config.headerScrubbing.Allow
+		}
+		if scrubbing.Deny == nil {
+			scrubbing.Deny = config.headerScrubbing.Deny
+		}
+		if scrubbing.Redact == nil {
+			scrubbing.Redact = config.headerScrubbing.Redact
+		}
+		if scrubbing.RedactValue == "" {
+			scrubbing.RedactValue = config.headerScrubbing.RedactValue
+		}
+		config.headerScrubbing = scrubbing
+	}
+	if fileConfig.Namespace != nil {
+		namespace := *fileConfig.Namespace
+		if namespace.Source == "" {
+			namespace.Source = namespaceNone
+		}
+		if namespace.Header == "" {
+			namespace.Header = config.namespace.Header
+		}
+		if err := namespace.validate(); err != nil {
+			return err
+		}
+		config.namespace = namespace
+	}
+	if fileConfig.Templates != nil {
+		config.templates = fileConfig.Templates
+	}
+	if fileConfig.Faults != nil {
+		config.faults = fileConfig.Faults
+	}
+	if fileConfig.FaultHeader != "" {
+		config.faultHeader = fileConfig.FaultHeader
+	}
+	if fileConfig.FaultTimeoutMs > 0 {
+		config.faultTimeout = time.Duration(fileConfig.FaultTimeoutMs) * time.Millisecond
+	}
+	return nil
+}
+
+// Create a recording from the egress fields of a response
+func newRecording(namespace, glPath string, payload, headers, statusCode gjson.Result, latency time.Duration) router {
+	recording := router{
+		glPath:             glPath,
+		namespace:          namespace,
+		responsePayload:    json.RawMessage(payload.Raw),
+		responseHeaders:    json.RawMessage(headers.Raw),
+		responseStatusCode: json.RawMessage(statusCode.Raw),
+		latency:            latency,
+		completionTokens:   payload.Get(config.latency.CompletionTokensField).Int(),
+		recordedAt:         time.Now(),
+	}
+
+	// Event streams are stored chunk by chunk
+	if isEventStream(headers) || strings.HasPrefix(payload.String(), "data:") {
+		recording.chunks, recording.events, recording.streamDone = parseChunks(payload)
+		if len(recording.chunks) > 0 {
+			// Usage is only in the last chunk, if at all
+			recording.completionTokens = gjson.GetBytes(recording.chunks[len(recording.chunks)-1], config.latency.CompletionTokensField).Int()
+			if recording.completionTokens == 0 {
+				recording.completionTokens = int64(len(recording.chunks))
+			}
+		}
+		slog.Debug("recorded event stream", slog.Int("chunks", len(recording.chunks)))
+	}
+	return recording
+}
+
+// Find the recording for a mocked path in the namespace. Call with config.m locked
+func findRecording(namespace, mockedPath string) (router, bool) {
+	for key, r := range config.recordedRouters {
+		slog.Debug("checking path", slog.String("path", key.glPath), slog.String("namespace", key.namespace), slog.String("subpath", mockedPath))
+		if key.namespace == namespace && strings.HasPrefix(mockedPath, key.glPath) {
+			// Found a match
+			return r, true
+		}
+	}
+	if namespace != "" && config.namespace.FallbackShared {
+		return findRecording("", mockedPath)
+	}
+	return router{}, false
+}
+
+// Find the setting for a mocked path. Longest matching router prefix wins, then "default"
+func lookupRouterSetting[T any](settings map[string]T, mockedPath string) (T, bool) {
+	best := ""
+	for path := range settings {
+		if strings.HasPrefix(mockedPath, path) && len(path) > len(best) {
+			best = path
+		}
+	}
+	if best != "" {
+		return settings[best], true
+	}
+	setting, exists := settings["default"]
+	return setting, exists
 }
 
 // ------------------------------- DO --------------------------------
@@ -79,9 +313,20 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 
 			slog.Debug("received", slog.String("data", string(msg.Data)))
 			responseBytes := []byte{} // default response
+			var respondDelay time.Duration
 
 			defer func() {
 				// Always end by sending back a response
+				if respondDelay > 0 {
+					// Respond late without blocking the subscription
+					slog.Debug("delaying response", slog.Duration("delay", respondDelay))
+					delayedBytes := responseBytes
+					time.AfterFunc(respondDelay, func() {
+						msg.Respond(delayedBytes)
+						slog.Debug("sending back", slog.String("response", string(delayedBytes)))
+					})
+					return
+				}
 				msg.Respond(responseBytes)
 				slog.Debug("sending back", slog.String("response", string(responseBytes)))
 			}()
@@ -150,18 +395,43 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 
 				}
 
-				var recordedRouter *router = nil
-				for paths, r := range config.recordedRouters {
-					slog.Debug("checking path", slog.String("path", paths), slog.String("subpath", egressPayload))
-					if strings.HasPrefix(egressPayload, paths) {
-						// Found a match
-						recordedRouter = &r
-						break
+				// Inject a fault if requested by header or drawn from the router probabilities
+				fault := pickFault(msg.Data, egressPayload)
+				switch fault {
+				case faultRateLimit, faultServerError, faultUnavailable:
+					slog.Info("injecting fault", slog.String("fault", fault), slog.String("subpath", egressPayload))
+					responseBytes, err = json.Marshal(faultResponse(fault, egressPayload))
+					if err != nil {
+						slog.Error("error marshalling response", slog.Any("error", err))
 					}
+					return
+				case faultTimeout:
+					// Respond after gecholog has given up on the processor
+					slog.Info("injecting fault", slog.String("fault", fault), slog.String("subpath", egressPayload))
+					respondDelay = config.faultTimeout
+				}
+
+				var recordedRouter *router = nil
+				namespace := config.namespace.of(msg.Data)
+				config.m.Lock()
+				if r, found := findRecording(namespace, egressPayload); found {
+					recordedRouter = &r
 				}
+				config.m.Unlock()
 				if recordedRouter == nil {
-					slog.Warn("no mock router found")
-					return
+					if !config.synthetic.Enabled {
+						slog.Warn("no mock router found")
+						return
+					}
+
+					// Nothing recorded, fabricate a response from the request
+					slog.Debug("synthetic response", slog.String("subpath", egressPayload))
+					recordedRouter = &router{}
+					synthetic := syntheticResponse(egressPayload, gjson.GetBytes(msg.Data, "ingress_payload"))
+					recordedRouter.responsePayload = synthetic["egress_payload"]
+					recordedRouter.responseHeaders = synthetic["egress_headers"]
+					recordedRouter.responseStatusCode = synthetic["egress_status_code"]
+					recordedRouter.completionTokens = gjson.GetBytes(recordedRouter.responsePayload, config.latency.CompletionTokensField).Int()
 				}
 
 				// Prepare response
@@ -170,19 +440,51 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 				gechologData["egress_headers"] = recordedRouter.responseHeaders
 				gechologData["egress_status_code"] = recordedRouter.responseStatusCode
 
+				// Render templates so each replay gets fresh values
+				templates, _ := lookupRouterSetting(config.templates, egressPayload)
+				if recordedRouter.templated {
+					gechologData["egress_payload"] = renderTemplate(gechologData["egress_payload"], msg.Data, false)
+					gechologData["egress_headers"] = renderTemplate(gechologData["egress_headers"], msg.Data, true)
+				}
+				gechologData["egress_headers"] = applyTemplates(gechologData["egress_headers"], templates.Headers, msg.Data, true)
+
+				var streamDelay time.Duration
+				ingressPayload := gjson.GetBytes(msg.Data, "ingress_payload")
+				if len(recordedRouter.chunks) > 0 {
+					// Replay the recorded event stream
+					chunks := templateChunks(recordedRouter.chunks, templates.Payload, msg.Data, recordedRouter.templated)
+					gechologData["egress_payload"] = encodeEventStream(chunks, recordedRouter.events, recordedRouter.streamDone)
+					streamDelay = config.stream.duration(len(chunks))
+				} else {
+					gechologData["egress_payload"] = applyTemplates(gechologData["egress_payload"], templates.Payload, msg.Data, false)
+
+					// The request asks for a stream but the recording is a single completion
+					if ingressPayload.Get("stream").Bool() {
+						includeUsage := ingressPayload.Get("stream_options.include_usage").Bool()
+						if chunks, ok := synthesizeChunks(gechologData["egress_payload"], includeUsage); ok {
+							slog.Debug("synthesizing stream", slog.Int("chunks", len(chunks)))
+							gechologData["egress_payload"] = encodeEventStream(chunks, nil, true)
+							gechologData["egress_headers"] = eventStreamHeaders(gechologData["egress_headers"])
+							streamDelay = config.stream.duration(len(chunks))
+						}
+					}
+				}
+				if fault == faultMalformed || fault == faultTruncated {
+					slog.Info("injecting fault", slog.String("fault", fault), slog.String("subpath", egressPayload))
+					gechologData["egress_payload"] = corruptPayload(fault, gechologData["egress_payload"])
+				}
+
 				responseBytes, err = json.Marshal(&gechologData)
 				if err != nil {
 					slog.Error("error marshalling response", slog.Any("error", err))
 				}
 
 				// We simulate latency
-				if config.lambda <= 0 {
-					// No latency simulation
+				if respondDelay > 0 {
+					// Already delayed by a fault
 					return
 				}
-				sleepTime := int(rand.ExpFloat64()/config.lambda) * 100 // Exponential distribution in milliseconds
-				slog.Debug("sleeping", slog.Int("sleepTime", sleepTime))
-				time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+				respondDelay = config.latency.sample(*recordedRouter) + streamDelay
 
 				return
 			}
@@ -210,16 +512,27 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 				return
 			}
 
+			recordedLatency := time.Duration(gjson.GetBytes(msg.Data, config.latency.RecordedLatencyField).Float() * float64(time.Millisecond))
+			scrubbedHeaders := config.headerScrubbing.scrub(egressHeadersExtract)
+			namespace := config.namespace.of(msg.Data)
+			recording := newRecording(namespace, glPath, egressPayloadExtract, scrubbedHeaders, egressStatusCodeExtract, recordedLatency)
+
+			// Only representative responses become recordings
+			if reason, rejected := config.recordingRules.reject(recording); rejected {
+				slog.Debug("not recording response", slog.String("gl_path", glPath), slog.String("reason", reason))
+				return
+			}
+
 			// Store the response
-			slog.Debug("storing response", slog.String("gl_path", glPath))
 			config.m.Lock() // mutex lock since maps are not thread safe for writing
-			config.recordedRouters[glPath] = router{
-				glPath:             glPath,
-				responsePayload:    json.RawMessage(egressPayload),
-				responseHeaders:    json.RawMessage(egressHeaders),
-				responseStatusCode: json.RawMessage(egressStatusCode),
+			defer config.m.Unlock()
+			key := recordingKey{namespace: namespace, glPath: glPath}
+			if config.recordingFrozen || config.recordedRouters[key].frozen {
+				slog.Debug("recording frozen, not storing response", slog.String("gl_path", glPath), slog.String("namespace", namespace))
+				return
 			}
-			config.m.Unlock()
+			slog.Debug("storing response", slog.String("gl_path", glPath), slog.String("namespace", namespace))
+			config.recordedRouters[key] = recording
 
 		},
 	)
@@ -230,6 +543,18 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 	}
 	defer sub.Unsubscribe()
 
+	// Management interface for the recordings, request/reply
+	adminSub, err := nc.Subscribe(config.adminSubject, func(msg *nats.Msg) {
+		slog.Debug("admin received", slog.String("data", string(msg.Data)))
+		msg.Respond(handleAdmin(msg.Data))
+	})
+	if err != nil {
+		slog.Error("error subscribing to admin subject", slog.Any("error", err))
+		cancel()
+		return
+	}
+	defer adminSub.Unsubscribe()
+
 	// Wait for messages
 	slog.Info("Connected to NATS server!")
 	<-ctx.Done()
@@ -250,9 +575,23 @@ func main() {
 	config.natsServer = "nats://" + glHost + ":4222"
 	config.natsToken = os.Getenv("NATS_TOKEN")
 
-	lambda := os.Getenv("LAMBDA") // Used for latency simulation
+	lambda := os.Getenv("LAMBDA") // Used for latency simulation, overridden by latency in MOCK_CONFIG
 	if lambda != "" {
-		config.lambda, _ = strconv.ParseFloat(lambda, 64)
+		l, _ := strconv.ParseFloat(lambda, 64)
+		if l > 0 {
+			// Exponential distribution with mean 100/LAMBDA milliseconds
+			config.latency.Model = latencyExponential
+			config.latency.MeanMs = 100 / l
+		}
+	}
+
+	mockConfig := os.Getenv("MOCK_CONFIG") // Optional json file with fault injection settings
+	if mockConfig != "" {
+		err := loadConfigFile(mockConfig)
+		if err != nil {
+			slog.Error("error reading config file", slog.String("file", mockConfig), slog.Any("error", err))
+			return
+		}
 	}
 
 	// Create context & sync
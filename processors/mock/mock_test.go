@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
+)
+
+// The tests run the processor against an in-process nats-server and send it the
+// messages gecholog sends in request and response context
+
+var testConn *nats.Conn
+
+const (
+	testRouter  = "/service/standard/"
+	testSubpath = "service/standard/openai/deployments/gpt4/chat/completions"
+	testPayload = `{"id":"chatcmpl-8nZCiOLutrIDeVT94lyXkYzdKtkDe","object":"chat.completion","created":1706824088,"model":"gpt-35-turbo","choices":[{"finish_reason":"length","index":0,"message":{"role":"assistant","content":"The founders of Microsoft are Bill Gates and Paul Allen."}}],"usage":{"prompt_tokens":29,"completion_tokens":15,"total_tokens":44}}`
+	testHeaders = `{"Content-Type":["application/json"],"Session-Id":["TST00001_1709042087441156891_5_0"]}`
+	testRequest = `{"messages":[{"role":"user","content":"Who were the founders of Microsoft?"}],"max_tokens":15}`
+)
+
+func TestMain(m *testing.M) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		fmt.Println("error creating nats-server:", err)
+		os.Exit(1)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		fmt.Println("nats-server not ready")
+		os.Exit(1)
+	}
+
+	config.natsServer = ns.ClientURL()
+	ctx, cancel := context.WithCancel(context.Background())
+	go do(ctx, cancel)
+
+	testConn, err = nats.Connect(ns.ClientURL())
+	if err != nil {
+		fmt.Println("error connecting to nats-server:", err)
+		os.Exit(1)
+	}
+
+	// Wait for the processor to subscribe
+	ready := false
+	for i := 0; i < 100 && !ready; i++ {
+		_, err := testConn.Request(config.natsSubject, []byte(`{}`), 100*time.Millisecond)
+		ready = err == nil
+	}
+	if !ready {
+		fmt.Println("processor not ready")
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	cancel()
+	testConn.Close()
+	ns.Shutdown()
+	os.Exit(code)
+}
+
+// Start each test with no recordings and restore the settings afterwards
+func resetConfig(t *testing.T) {
+	t.Helper()
+	config.m.Lock()
+	saved := config
+	config.recordedRouters = make(map[recordingKey]router, 10)
+	config.recordingFrozen = false
+	config.m.Unlock()
+	t.Cleanup(func() {
+		config.m.Lock()
+		defer config.m.Unlock()
+		config = saved
+		config.recordedRouters = make(map[recordingKey]router, 10)
+	})
+}
+
+func send(t *testing.T, message string) gjson.Result {
+	t.Helper()
+	reply, err := testConn.Request(config.natsSubject, []byte(message), 5*time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return gjson.ParseBytes(reply.Data)
+}
+
+// A response context message for a real router
+func realResponse(glPath, payload, headers string, statusCode int) string {
+	return fmt.Sprintf(`{"gl_path":%q,"ingress_headers":{},"ingress_payload":%s,"egress_payload":%s,"egress_headers":%s,"egress_status_code":%d,"outbound_inbound_timer":{"duration":420}}`,
+		glPath, testRequest, payload, headers, statusCode)
+}
+
+// A response context message for the mock router, egress_payload is what mock wrote to control
+func mockResponse(subpath, ingressHeaders string) string {
+	if ingressHeaders == "" {
+		ingressHeaders = "{}"
+	}
+	return fmt.Sprintf(`{"gl_path":"/mock/","ingress_headers":%s,"ingress_payload":%s,"egress_payload":%q,"egress_headers":{},"egress_status_code":200}`,
+		ingressHeaders, testRequest, "/"+subpath)
+}
+
+func TestRequestContext(t *testing.T) {
+	resetConfig(t)
+
+	tests := []struct {
+		name    string
+		message string
+		control string
+	}{
+		{"mock router", `{"gl_path":"/mock/","ingress_subpath":"` + testSubpath + `"}`, "/" + testSubpath},
+		{"other router", `{"gl_path":"/service/standard/","ingress_subpath":"openai/deployments/gpt4/chat/completions"}`, ""},
+		{"mock router without subpath", `{"gl_path":"/mock/","ingress_subpath":""}`, ""},
+		{"missing gl_path", `{"ingress_subpath":"` + testSubpath + `"}`, ""},
+		{"invalid json", `not json`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := send(t, tt.message)
+			if got := reply.Get("control").String(); got != tt.control {
+				t.Errorf("control = %q, want %q", got, tt.control)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	resetConfig(t)
+
+	// Nothing recorded yet
+	reply := send(t, mockResponse(testSubpath, ""))
+	if reply.Exists() {
+		t.Fatalf("expected empty response without recording, got %s", reply.Raw)
+	}
+
+	// Recording does not change the response
+	reply = send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+	if reply.Exists() {
+		t.Fatalf("expected empty response when recording, got %s", reply.Raw)
+	}
+
+	reply = send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload.id").String(); got != "chatcmpl-8nZCiOLutrIDeVT94lyXkYzdKtkDe" {
+		t.Errorf("egress_payload.id = %q", got)
+	}
+	if got := reply.Get("egress_payload.choices.0.message.content").String(); got != "The founders of Microsoft are Bill Gates and Paul Allen." {
+		t.Errorf("content = %q", got)
+	}
+	if got := reply.Get("egress_headers.Content-Type.0").String(); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := reply.Get("egress_status_code").Int(); got != 200 {
+		t.Errorf("egress_status_code = %d", got)
+	}
+
+	// The last successful response wins, failures are not recorded
+	send(t, realResponse(testRouter, strings.Replace(testPayload, "chatcmpl-8nZCiOLutrIDeVT94lyXkYzdKtkDe", "chatcmpl-second", 1), testHeaders, 200))
+	send(t, realResponse(testRouter, `{"error":{"code":"429","message":"Rate limit"}}`, testHeaders, 429))
+	reply = send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload.id").String(); got != "chatcmpl-second" {
+		t.Errorf("egress_payload.id = %q, want chatcmpl-second", got)
+	}
+
+	// Routers are separated
+	reply = send(t, mockResponse("service/capped/openai/deployments/gpt4/chat/completions", ""))
+	if reply.Exists() {
+		t.Errorf("expected empty response for unrecorded router, got %s", reply.Raw)
+	}
+}
+
+func TestHeaderScrubbing(t *testing.T) {
+	resetConfig(t)
+
+	headers := `{"Content-Type":["application/json"],"Set-Cookie":["session=abc"],"X-Ratelimit-Remaining-Requests":["99"],"x-ratelimit-limit-tokens":["1000"],"Openai-Organization":["org-123"]}`
+	send(t, realResponse(testRouter, testPayload, headers, 200))
+
+	replayed := send(t, mockResponse(testSubpath, "")).Get("egress_headers")
+	for _, name := range []string{"Set-Cookie", "X-Ratelimit-Remaining-Requests", "x-ratelimit-limit-tokens"} {
+		if replayed.Get(name).Exists() {
+			t.Errorf("%s was recorded: %s", name, replayed.Raw)
+		}
+	}
+	if got := replayed.Get("Openai-Organization.0").String(); got != "[redacted]" {
+		t.Errorf("Openai-Organization = %q, want [redacted]", got)
+	}
+	if got := replayed.Get("Content-Type.0").String(); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestHeaderMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		match    bool
+	}{
+		{[]string{"Set-Cookie"}, "Set-Cookie", true},
+		{[]string{"Set-Cookie"}, "set-cookie", true},
+		{[]string{"set-cookie"}, "SET-COOKIE", true},
+		{[]string{"Set-Cookie"}, "Set-Cookie2", false},
+		{[]string{"X-Ratelimit-*"}, "X-Ratelimit-Remaining-Requests", true},
+		{[]string{"X-Ratelimit-*"}, "x-ratelimit-reset-tokens", true},
+		{[]string{"X-Ratelimit-*"}, "X-Ratelimit-", true},
+		{[]string{"X-Ratelimit-*"}, "X-Ratelimit", false},
+		{[]string{"X-Ratelimit-*"}, "X-Request-Id", false},
+		{[]string{"*"}, "Anything", true},
+		{[]string{}, "Content-Type", false},
+	}
+	for _, tt := range tests {
+		if got := headerMatches(tt.patterns, tt.name); got != tt.match {
+			t.Errorf("headerMatches(%q, %q) = %v, want %v", tt.patterns, tt.name, got, tt.match)
+		}
+	}
+}
+
+// Header scrubbing lists missing in the config file keep the defaults
+func TestHeaderScrubbingConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want headerScrubbing
+	}{
+		{"allow only", `{"header_scrubbing":{"allow":["Content-Type","Openai-*"]}}`, headerScrubbing{
+			Allow: []string{"Content-Type", "Openai-*"}, Deny: defaultHeaderScrubbing.Deny, Redact: defaultHeaderScrubbing.Redact, RedactValue: "[redacted]",
+		}},
+		{"replace deny and redact value", `{"header_scrubbing":{"deny":["Date"],"redact_value":"***"}}`, headerScrubbing{
+			Allow: []string{}, Deny: []string{"Date"}, Redact: defaultHeaderScrubbing.Redact, RedactValue: "***",
+		}},
+		{"empty lists turn a list off", `{"header_scrubbing":{"deny":[],"redact":[]}}`, headerScrubbing{
+			Allow: []string{}, Deny: []string{}, Redact: []string{}, RedactValue: "[redacted]",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConfig(t)
+			path := filepath.Join(t.TempDir(), "mock_config.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfigFile(path); err != nil {
+				t.Fatal(err)
+			}
+			got := config.headerScrubbing
+			if !slices.Equal(got.Allow, tt.want.Allow) || !slices.Equal(got.Deny, tt.want.Deny) || !slices.Equal(got.Redact, tt.want.Redact) || got.RedactValue != tt.want.RedactValue {
+				t.Errorf("header_scrubbing = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntheticResponse(t *testing.T) {
+	resetConfig(t)
+	config.synthetic.Enabled = true
+
+	reply := send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload.object").String(); got != "chat.completion" {
+		t.Errorf("object = %q", got)
+	}
+	if got := reply.Get("egress_payload.usage.completion_tokens").Int(); got != 15 {
+		t.Errorf("completion_tokens = %d, want max_tokens 15", got)
+	}
+	if got := reply.Get("egress_payload.model").String(); got != "gpt4" {
+		t.Errorf("model = %q, want deployment gpt4", got)
+	}
+
+	// A huge max_tokens is capped
+	for _, maxTokens := range []string{"1000000000000000", "9223372036854775807"} {
+		reply = send(t, strings.Replace(mockResponse(testSubpath, ""), `"max_tokens":15`, `"max_tokens":`+maxTokens, 1))
+		if got := reply.Get("egress_payload.usage.completion_tokens").Int(); got != int64(config.synthetic.MaxTokens) {
+			t.Errorf("completion_tokens = %d for max_tokens %s, want the cap %d", got, maxTokens, config.synthetic.MaxTokens)
+		}
+	}
+}
+
+func TestStreamReplay(t *testing.T) {
+	resetConfig(t)
+	send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+
+	message := strings.Replace(mockResponse(testSubpath, ""), `"max_tokens":15`, `"max_tokens":15,"stream":true`, 1)
+	reply := send(t, message)
+	if got := reply.Get("egress_headers.Content-Type.0").String(); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	stream := reply.Get("egress_payload").String()
+	if !strings.HasSuffix(stream, "data: [DONE]\n\n") {
+		t.Errorf("stream does not end with [DONE]: %q", stream)
+	}
+
+	// The deltas add up to the recorded content
+	content := ""
+	chunks, _, _ := parseChunks(reply.Get("egress_payload"))
+	for _, chunk := range chunks {
+		content += gjson.GetBytes(chunk, "choices.0.delta.content").String()
+	}
+	if content != "The founders of Microsoft are Bill Gates and Paul Allen." {
+		t.Errorf("streamed content = %q", content)
+	}
+}
+
+func TestFaultHeader(t *testing.T) {
+	resetConfig(t)
+	send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+
+	reply := send(t, mockResponse(testSubpath, `{"Mock-Fault":["429"]}`))
+	if got := reply.Get("egress_status_code").Int(); got != 429 {
+		t.Errorf("egress_status_code = %d, want 429", got)
+	}
+	if !reply.Get("egress_headers.Retry-After").Exists() {
+		t.Errorf("missing Retry-After header")
+	}
+
+	reply = send(t, mockResponse(testSubpath, `{"mock-fault":["truncated"]}`))
+	if json.Valid([]byte(reply.Get("egress_payload").String())) {
+		t.Errorf("truncated payload is valid json")
+	}
+}
+
+func TestCorruptPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"ascii", `{"content":"abcdef"}`},
+		{"multibyte at the cut", `{"c":"ååååååå"}`},
+		{"emoji", `{"c":"👍🏽👍🏽👍🏽👍🏽"}`},
+		{"event stream", `"data: {\"c\":\"éééé\"}\n\n"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var broken string
+			if err := json.Unmarshal(corruptPayload(faultTruncated, json.RawMessage(tt.payload)), &broken); err != nil {
+				t.Fatalf("corrupted payload is not a json string: %v", err)
+			}
+			if strings.ContainsRune(broken, utf8.RuneError) {
+				t.Errorf("truncated payload %q contains U+FFFD", broken)
+			}
+			if !utf8.ValidString(broken) {
+				t.Errorf("truncated payload %q is not valid UTF-8", broken)
+			}
+		})
+	}
+}
+
+func TestLatencySimulation(t *testing.T) {
+	resetConfig(t)
+	config.latency = latencyModel{Model: latencyFixed, MeanMs: 200}
+	send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+
+	// Each reply is delayed, but delays do not block each other
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := send(t, mockResponse(testSubpath, "")); !reply.Get("egress_payload").Exists() {
+				t.Errorf("missing egress_payload")
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("replies after %v, want at least 200ms", elapsed)
+	}
+	if elapsed > 900*time.Millisecond {
+		t.Errorf("replies after %v, delays are blocking each other", elapsed)
+	}
+}
+
+func TestLatencyModels(t *testing.T) {
+	const samples = 20000
+	recorded := router{latency: 420 * time.Millisecond, completionTokens: 10}
+
+	mean := func(l latencyModel) (float64, float64, float64) {
+		sum, low, high := 0.0, math.Inf(1), 0.0
+		for i := 0; i < samples; i++ {
+			ms := float64(l.sample(recorded)) / float64(time.Millisecond)
+			sum += ms
+			low = min(low, ms)
+			high = max(high, ms)
+		}
+		return sum / samples, low, high
+	}
+
+	tests := []struct {
+		name      string
+		model     latencyModel
+		mean      float64
+		tolerance float64
+		low, high float64
+	}{
+		{"none", latencyModel{Model: latencyNone}, 0, 0, 0, 0},
+		{"fixed", latencyModel{Model: latencyFixed, MeanMs: 250}, 250, 0, 250, 250},
+		{"uniform", latencyModel{Model: latencyUniform, MinMs: 100, MaxMs: 300}, 200, 0.05, 100, 300},
+		{"exponential keeps milliseconds", latencyModel{Model: latencyExponential, MeanMs: 50}, 50, 0.05, 0, math.Inf(1)},
+		{"lognormal", latencyModel{Model: latencyLogNormal, MeanMs: 500, Sigma: 0.5}, 500, 0.05, 0, math.Inf(1)},
+		{"capped", latencyModel{Model: latencyExponential, MeanMs: 1000, MinMs: 10, MaxMs: 20}, 20, 0.05, 10, 20},
+		{"replay", latencyModel{Model: latencyReplay, MeanMs: 100}, 420, 0, 420, 420},
+		{"per token", latencyModel{Model: latencyFixed, MeanMs: 100, MsPerCompletionToken: 5}, 150, 0, 150, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.model.validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			got, low, high := mean(tt.model)
+			if math.Abs(got-tt.mean) > tt.mean*tt.tolerance+1e-9 {
+				t.Errorf("mean = %.2f ms, want %.2f ms", got, tt.mean)
+			}
+			if low < tt.low || high > tt.high {
+				t.Errorf("range [%.2f, %.2f] outside [%.2f, %.2f]", low, high, tt.low, tt.high)
+			}
+		})
+	}
+}
+
+func TestConcurrentRecordAndReplay(t *testing.T) {
+	resetConfig(t)
+
+	routers := []string{"/service/standard/", "/service/capped/", "/restricted/"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		glPath := routers[i%len(routers)]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			payload := fmt.Sprintf(`{"id":"%s","object":"chat.completion","choices":[]}`, glPath)
+			send(t, realResponse(glPath, payload, testHeaders, 200))
+		}()
+		go func() {
+			defer wg.Done()
+			reply := send(t, mockResponse(strings.TrimPrefix(glPath, "/")+"openai/chat/completions", ""))
+			// Either not recorded yet or the recording of this router
+			if id := reply.Get("egress_payload.id"); id.Exists() && id.String() != glPath {
+				t.Errorf("replayed %q for %q", id.String(), glPath)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, glPath := range routers {
+		reply := send(t, mockResponse(strings.TrimPrefix(glPath, "/")+"openai/chat/completions", ""))
+		if got := reply.Get("egress_payload.id").String(); got != glPath {
+			t.Errorf("replayed %q for %q", got, glPath)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	resetConfig(t)
+
+	admin := func(message string) gjson.Result {
+		t.Helper()
+		reply, err := testConn.Request(config.adminSubject, []byte(message), 5*time.Second)
+		if err != nil {
+			t.Fatalf("admin request failed: %v", err)
+		}
+		return gjson.ParseBytes(reply.Data)
+	}
+
+	send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+	if got := admin(`{"action":"list"}`).Get("recordings.#").Int(); got != 1 {
+		t.Fatalf("recordings = %d, want 1", got)
+	}
+
+	// Frozen recordings are not overwritten
+	if reply := admin(`{"action":"freeze","gl_path":"/service/standard/"}`); !reply.Get("ok").Bool() {
+		t.Fatalf("freeze failed: %s", reply.Raw)
+	}
+	send(t, realResponse(testRouter, `{"id":"overwritten"}`, testHeaders, 200))
+	if got := admin(`{"action":"get","gl_path":"/service/standard/"}`).Get("recordings.0.egress_payload.id").String(); got == "overwritten" {
+		t.Errorf("frozen recording was overwritten")
+	}
+
+	// Uploaded recordings are replayed
+	reply := admin(`{"action":"put","gl_path":"/service/capped/","egress_payload":{"id":"uploaded"},"egress_headers":{},"egress_status_code":200}`)
+	if !reply.Get("ok").Bool() {
+		t.Fatalf("put failed: %s", reply.Raw)
+	}
+	if got := send(t, mockResponse("service/capped/chat/completions", "")).Get("egress_payload.id").String(); got != "uploaded" {
+		t.Errorf("replayed %q, want uploaded", got)
+	}
+
+	if reply := admin(`{"action":"get","gl_path":"/unknown/"}`); reply.Get("ok").Bool() {
+		t.Errorf("get of unknown recording succeeded")
+	}
+	admin(`{"action":"clear"}`)
+	if got := admin(`{"action":"list"}`).Get("recordings.#").Int(); got != 0 {
+		t.Errorf("recordings after clear = %d", got)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	resetConfig(t)
+	config.templates = map[string]templateSettings{
+		"default": {
+			Payload: map[string]string{"id": "chatcmpl-{{id 29}}", "created": "{{unix}}"},
+			Headers: map[string]string{"X-Request-Id": "{{uuid}}"},
+		},
+	}
+
+	// Configured paths are rendered when the recording has them
+	send(t, realResponse(testRouter, testPayload, testHeaders, 200))
+	reply := send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload.id").String(); got == "chatcmpl-8nZCiOLutrIDeVT94lyXkYzdKtkDe" || !strings.HasPrefix(got, "chatcmpl-") || len(got) != len("chatcmpl-")+29 {
+		t.Errorf("id = %q, want a fresh id", got)
+	}
+	if got := reply.Get("egress_payload.created"); got.Type != gjson.Number || got.Int() == 1706824088 {
+		t.Errorf("created = %s, want the current unix time", got.Raw)
+	}
+	if got := reply.Get("egress_headers.X-Request-Id.0").String(); len(got) != 36 {
+		t.Errorf("X-Request-Id = %q, want a uuid", got)
+	}
+
+	// Paths the recording does not have are not added
+	embeddings := `{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.1,0.2]}],"model":"ada"}`
+	send(t, realResponse("/service/capped/", embeddings, testHeaders, 200))
+	reply = send(t, mockResponse("service/capped/openai/deployments/ada/embeddings", ""))
+	if reply.Get("egress_payload.id").Exists() || reply.Get("egress_payload.created").Exists() {
+		t.Errorf("template added fields to %s", reply.Get("egress_payload").Raw)
+	}
+
+	// Placeholders in recorded traffic are replayed as is
+	content := "Use {{ id }} and {{now}} in Jinja"
+	withPlaceholders := strings.Replace(testPayload, "The founders of Microsoft are Bill Gates and Paul Allen.", content, 1)
+	send(t, realResponse(testRouter, withPlaceholders, testHeaders, 200))
+	reply = send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload.choices.0.message.content").String(); got != content {
+		t.Errorf("content = %q, want %q", got, content)
+	}
+
+	// Placeholders in templated uploads are rendered
+	handleAdmin([]byte(`{"action":"put","gl_path":"/templated/","egress_payload":{"object":"chat.completion","seen":"{{header X-Test}}","model":"{{request model}}"},"egress_headers":{},"egress_status_code":200,"templated":true}`))
+	message := strings.Replace(mockResponse("templated/chat/completions", `{"X-Test":["hello"]}`), `"max_tokens":15`, `"max_tokens":15,"model":"gpt-x"`, 1)
+	reply = send(t, message)
+	if got := reply.Get("egress_payload.seen").String(); got != "hello" {
+		t.Errorf("seen = %q, want hello", got)
+	}
+	if got := reply.Get("egress_payload.model").String(); got != "gpt-x" {
+		t.Errorf("model = %q, want gpt-x", got)
+	}
+}
+
+func TestStreamReplayNamedEvents(t *testing.T) {
+	resetConfig(t)
+
+	// An Anthropic stream names every event and has no [DONE]
+	anthropic := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\",\"role\":\"assistant\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	payload, _ := json.Marshal(anthropic)
+	send(t, realResponse(testRouter, string(payload), `{"Content-Type":["text/event-stream"]}`, 200))
+
+	reply := send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload").String(); got != anthropic {
+		t.Errorf("replayed stream = %q, want %q", got, anthropic)
+	}
+
+	// OpenAI streams keep their [DONE]
+	openai := "data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"
+	payload, _ = json.Marshal(openai)
+	send(t, realResponse(testRouter, string(payload), `{"Content-Type":["text/event-stream"]}`, 200))
+
+	reply = send(t, mockResponse(testSubpath, ""))
+	if got := reply.Get("egress_payload").String(); got != openai {
+		t.Errorf("replayed stream = %q, want %q", got, openai)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	resetConfig(t)
+	config.namespace = namespaceSettings{Source: namespaceHeader, Header: "Mock-Namespace"}
+
+	recordFor := func(namespace, id string) {
+		message := strings.Replace(realResponse(testRouter, strings.Replace(testPayload, "chatcmpl-8nZCiOLutrIDeVT94lyXkYzdKtkDe", id, 1), testHeaders, 200),
+			`"ingress_headers":{}`, `"ingress_headers":{"Mock-Namespace":["`+namespace+`"]}`, 1)
+		send(t, message)
+	}
+	recordFor("alice", "answer1")
+	recordFor("bob", "answer2")
+
+	for namespace, want := range map[string]string{"alice": "answer1", "bob": "answer2"} {
+		reply := send(t, mockResponse(testSubpath, `{"Mock-Namespace":["`+namespace+`"]}`))
+		if got := reply.Get("egress_payload.id").String(); got != want {
+			t.Errorf("%s replayed %q, want %q", namespace, got, want)
+		}
+	}
+
+	// No shared recording to fall back to
+	if reply := send(t, mockResponse(testSubpath, `{"Mock-Namespace":["carol"]}`)); reply.Exists() {
+		t.Errorf("carol replayed %s", reply.Raw)
+	}
+	config.namespace.FallbackShared = true
+	recordFor("", "shared")
+	if got := send(t, mockResponse(testSubpath, `{"Mock-Namespace":["carol"]}`)).Get("egress_payload.id").String(); got != "shared" {
+		t.Errorf("carol replayed %q, want shared", got)
+	}
+}
+
+// Bad placeholder arguments are left as is, they never stop the processor
+func TestPlaceholderArguments(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		check    func(gjson.Result) bool
+	}{
+		{"negative id", `"{{id -1}}"`, func(r gjson.Result) bool { return r.String() == "{{id -1}}" }},
+		{"zero id", `"{{id 0}}"`, func(r gjson.Result) bool { return r.String() == "{{id 0}}" }},
+		{"huge id", `"{{id 1000000000}}"`, func(r gjson.Result) bool { return r.String() == "{{id 1000000000}}" }},
+		{"max id", `"{{id 256}}"`, func(r gjson.Result) bool { return len(r.String()) == 256 }},
+		{"randint max < min", `"{{randint 9 1}}"`, func(r gjson.Result) bool { return r.String() == "{{randint 9 1}}" }},
+		{"randint wide range", `"{{randint 0 9223372036854775807}}"`, func(r gjson.Result) bool { return r.Type == gjson.Number && r.Int() >= 0 }},
+		{"randint full range", `"{{randint -9223372036854775808 9223372036854775807}}"`, func(r gjson.Result) bool { return r.Type == gjson.Number }},
+		{"randint negative range", `"{{randint -5 -3}}"`, func(r gjson.Result) bool { return r.Int() >= -5 && r.Int() <= -3 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got := renderTemplate(json.RawMessage(tt.template), nil, false)
+				if !tt.check(gjson.ParseBytes(got)) {
+					t.Fatalf("renderTemplate(%s) = %s", tt.template, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordingRules(t *testing.T) {
+	recording := func(glPath, payload string, statusCode int) router {
+		return newRecording("", glPath, gjson.Parse(payload), gjson.Parse(testHeaders), gjson.Parse(fmt.Sprint(statusCode)), 0)
+	}
+	stream := newRecording("", testRouter,
+		gjson.Parse(`"data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: {\"choices\":[{\"finish_reason\":\"content_filter\"}]}\n\ndata: [DONE]\n\n"`),
+		gjson.Parse(`{"Content-Type":["text/event-stream"]}`), gjson.Parse("200"), 0)
+
+	tests := []struct {
+		name      string
+		rules     recordingRules
+		recording router
+		reject    bool
+	}{
+		{"no rules", recordingRules{}, recording(testRouter, testPayload, 200), false},
+		{"not successful", recordingRules{}, recording(testRouter, testPayload, 429), true},
+		{"status code allowed", recordingRules{StatusCodes: []int{200, 429}}, recording(testRouter, testPayload, 429), false},
+		{"status code not allowed", recordingRules{StatusCodes: []int{200}}, recording(testRouter, testPayload, 201), true},
+		{"included router", recordingRules{IncludeRouters: []string{"/service/"}}, recording(testRouter, testPayload, 200), false},
+		{"router not included", recordingRules{IncludeRouters: []string{"/service/capped/"}}, recording(testRouter, testPayload, 200), true},
+		{"excluded router", recordingRules{ExcludeRouters: []string{"/service/"}}, recording(testRouter, testPayload, 200), true},
+		{"exclude wins over include", recordingRules{IncludeRouters: []string{"/service/"}, ExcludeRouters: []string{"/service/standard/"}}, recording(testRouter, testPayload, 200), true},
+		{"router not excluded", recordingRules{ExcludeRouters: []string{"/echo/"}}, recording(testRouter, testPayload, 200), false},
+		{"require matched", recordingRules{Require: []string{"choices.0.message.content"}}, recording(testRouter, testPayload, 200), false},
+		{"require not matched", recordingRules{Require: []string{"choices.0.message.tool_calls"}}, recording(testRouter, testPayload, 200), true},
+		{"require false value", recordingRules{Require: []string{"cached"}}, recording(testRouter, `{"cached":false}`, 200), true},
+		{"reject matched", recordingRules{Reject: []string{`choices.#(finish_reason=="length")`}}, recording(testRouter, testPayload, 200), true},
+		{"reject not matched", recordingRules{Reject: []string{`choices.#(finish_reason=="content_filter")`}}, recording(testRouter, testPayload, 200), false},
+		{"reject matched in a stream chunk", recordingRules{Reject: []string{`choices.#(finish_reason=="content_filter")`}}, stream, true},
+		{"require matched in a stream chunk", recordingRules{Require: []string{"choices.0.delta.content"}}, stream, false},
+		{"payload below max", recordingRules{MaxPayloadBytes: len(testPayload)}, recording(testRouter, testPayload, 200), false},
+		{"payload above max", recordingRules{MaxPayloadBytes: len(testPayload) - 1}, recording(testRouter, testPayload, 200), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, rejected := tt.rules.reject(tt.recording)
+			if rejected != tt.reject {
+				t.Errorf("reject = %v (%q), want %v", rejected, reason, tt.reject)
+			}
+			if rejected && reason == "" {
+				t.Error("rejected without a reason")
+			}
+		})
+	}
+}
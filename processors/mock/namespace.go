@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// Namespace sources
+const (
+	namespaceNone   = "none"
+	namespaceHeader = "header"
+)
+
+// How recordings are separated between clients sharing one mock
+type namespaceSettings struct {
+	Source         string `json:"source"`          // none or header
+	Header         string `json:"header"`          // header holding the namespace for source header
+	FallbackShared bool   `json:"fallback_shared"` // replay shared recordings when the namespace has none
+}
+
+// Recordings are keyed by namespace and router
+type recordingKey struct {
+	namespace string
+	glPath    string
+}
+
+func (n namespaceSettings) validate() error {
+	switch n.Source {
+	case namespaceNone:
+	case namespaceHeader:
+		if n.Header == "" {
+			return fmt.Errorf("namespace source header needs a header name")
+		}
+	default:
+		return fmt.Errorf("unknown namespace source %q", n.Source)
+	}
+	return nil
+}
+
+// Find the namespace of the client from the ingress headers. Empty is the shared namespace
+func (n namespaceSettings) of(data []byte) string {
+	switch n.Source {
+	case namespaceHeader:
+		return headerValue(data, n.Header)
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Rules deciding which real responses become recordings
+type recordingRules struct {
+	StatusCodes     []int    `json:"status_codes"`      // empty means any 2xx
+	Require         []string `json:"require"`           // gjson paths that must match in egress_payload
+	Reject          []string `json:"reject"`            // gjson paths that must not match in egress_payload
+	IncludeRouters  []string `json:"include_routers"`   // gl_path prefixes to record, empty means all
+	ExcludeRouters  []string `json:"exclude_routers"`   // gl_path prefixes never to record
+	MaxPayloadBytes int      `json:"max_payload_bytes"` // 0 means no limit
+}
+
+func (rules recordingRules) validate() error {
+	for _, path := range slices.Concat(rules.Require, rules.Reject) {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("empty gjson path in recording rules")
+		}
+	}
+	if rules.MaxPayloadBytes < 0 {
+		return fmt.Errorf("max_payload_bytes must not be negative")
+	}
+	return nil
+}
+
+// Check a recording against the rules. Returns the reason if it should not be stored
+func (rules recordingRules) reject(recording router) (string, bool) {
+
+	if len(rules.IncludeRouters) > 0 && !slices.ContainsFunc(rules.IncludeRouters, func(prefix string) bool {
+		return strings.HasPrefix(recording.glPath, prefix)
+	}) {
+		return "router not included", true
+	}
+	if slices.ContainsFunc(rules.ExcludeRouters, func(prefix string) bool {
+		return strings.HasPrefix(recording.glPath, prefix)
+	}) {
+		return "router excluded", true
+	}
+
+	statusCode := int(gjson.ParseBytes(recording.responseStatusCode).Int())
+	if len(rules.StatusCodes) > 0 {
+		if !slices.Contains(rules.StatusCodes, statusCode) {
+			return fmt.Sprintf("status code %d not allowed", statusCode), true
+		}
+	} else if statusCode < 200 || statusCode > 299 {
+		return fmt.Sprintf("status code %d not successful", statusCode), true
+	}
+
+	if rules.MaxPayloadBytes > 0 && len(recording.responsePayload) > rules.MaxPayloadBytes {
+		return fmt.Sprintf("payload size %d above max", len(recording.responsePayload)), true
+	}
+
+	for _, path := range rules.Require {
+		if !recordingMatches(recording, path) {
+			return fmt.Sprintf("required %q not matched", path), true
+		}
+	}
+	for _, path := range rules.Reject {
+		if recordingMatches(recording, path) {
+			return fmt.Sprintf("rejected %q matched", path), true
+		}
+	}
+	return "", false
+}
+
+// True if the gjson path matches the payload, or any chunk of an event stream,
+// with a value that is not false or null
+func recordingMatches(recording router, path string) bool {
+	truthy := func(r gjson.Result) bool {
+		return r.Exists() && r.Type != gjson.False && r.Type != gjson.Null
+	}
+	if len(recording.chunks) == 0 {
+		return truthy(gjson.GetBytes(recording.responsePayload, path))
+	}
+	return slices.ContainsFunc(recording.chunks, func(chunk json.RawMessage) bool {
+		return truthy(gjson.GetBytes(chunk, path))
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Timing and shape of replayed server-sent event streams. gecholog gets the whole stream
+// in one egress_payload, so the timing is spent before mock responds
+type streamSettings struct {
+	FirstChunkMs    float64 `json:"first_chunk_ms"`    // time to first chunk
+	ChunkIntervalMs float64 `json:"chunk_interval_ms"` // mean time between chunks
+	WordsPerChunk   int     `json:"words_per_chunk"`   // when synthesizing chunks from a completion
+}
+
+const eventStreamDone = "[DONE]"
+
+// True if the response headers announce a server-sent event stream
+func isEventStream(headers gjson.Result) bool {
+	stream := false
+	headers.ForEach(func(key, values gjson.Result) bool {
+		if strings.EqualFold(key.String(), "Content-Type") {
+			stream = strings.Contains(values.Get("0").String(), "text/event-stream")
+			return false
+		}
+		return true
+	})
+	return stream
+}
+
+// Split a recorded stream into its json chunks and the event name of each chunk, empty if
+// the chunk had no event line. done is true if the stream ended with data: [DONE], like
+// OpenAI streams. Anthropic streams name every event and have no [DONE]. The payload is
+// either the raw event stream as a json string or an array of chunks, which is sent with [DONE]
+func parseChunks(payload gjson.Result) (chunks []json.RawMessage, events []string, done bool) {
+	if payload.IsArray() {
+		payload.ForEach(func(_, chunk gjson.Result) bool {
+			chunks = append(chunks, json.RawMessage(chunk.Raw))
+			events = append(events, "")
+			return true
+		})
+		return chunks, events, true
+	}
+
+	event := ""
+	for _, line := range strings.Split(payload.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			// The event name ends with the event
+			event = ""
+			continue
+		}
+		if name, found := strings.CutPrefix(line, "event:"); found {
+			event = strings.TrimSpace(name)
+			continue
+		}
+		data, found := strings.CutPrefix(line, "data:")
+		if !found {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == eventStreamDone {
+			done = true
+			continue
+		}
+		if !json.Valid([]byte(data)) {
+			continue
+		}
+		chunks = append(chunks, json.RawMessage(data))
+		events = append(events, event)
+	}
+	return chunks, events, done
+}
+
+// Encode chunks as an event stream in a json string, ready for egress_payload. events
+// has the event name of each chunk, or is nil for data only streams
+func encodeEventStream(chunks []json.RawMessage, events []string, done bool) json.RawMessage {
+	var sb strings.Builder
+	for i, chunk := range chunks {
+		if i < len(events) && events[i] != "" {
+			sb.WriteString("event: " + events[i] + "\n")
+		}
+		sb.WriteString("data: ")
+		sb.Write(chunk)
+		sb.WriteString("\n\n")
+	}
+	if done {
+		sb.WriteString("data: " + eventStreamDone + "\n\n")
+	}
+	encoded, _ := json.Marshal(sb.String())
+	return encoded
+}
+
+// Set the event stream content type on the response headers
+func eventStreamHeaders(headers json.RawMessage) json.RawMessage {
+	document := string(headers)
+	gjson.ParseBytes(headers).ForEach(func(key, _ gjson.Result) bool {
+		if strings.EqualFold(key.String(), "Content-Type") {
+			document, _ = sjson.Delete(document, key.String())
+		}
+		return true
+	})
+	updated, err := sjson.SetRaw(document, "Content-Type", `["text/event-stream"]`)
+	if err != nil {
+		return headers
+	}
+	return json.RawMessage(updated)
+}
+
+// Turn a recorded chat or text completion into stream chunks, the way OpenAI streams them.
+// Returns false if the payload is not an OpenAI completion
+func synthesizeChunks(completion json.RawMessage, includeUsage bool) ([]json.RawMessage, bool) {
+
+	payload := gjson.ParseBytes(completion)
+	object := payload.Get("object").String()
+	if object != "chat.completion" && object != "text_completion" {
+		return nil, false
+	}
+	chat := object == "chat.completion"
+
+	wordsPerChunk := config.stream.WordsPerChunk
+	if wordsPerChunk <= 0 {
+		wordsPerChunk = 1
+	}
+
+	base := map[string]any{
+		"id":      payload.Get("id").String(),
+		"object":  "text_completion",
+		"created": payload.Get("created").Int(),
+		"model":   payload.Get("model").String(),
+	}
+	if chat {
+		base["object"] = "chat.completion.chunk"
+	}
+	if fingerprint := payload.Get("system_fingerprint"); fingerprint.Exists() {
+		base["system_fingerprint"] = fingerprint.String()
+	}
+
+	chunk := func(choices []any) json.RawMessage {
+		c := make(map[string]any, len(base)+1)
+		for k, v := range base {
+			c[k] = v
+		}
+		c["choices"] = choices
+		b, _ := json.Marshal(c)
+		return b
+	}
+
+	var chunks []json.RawMessage
+	payload.Get("choices").ForEach(func(_, choice gjson.Result) bool {
+		index := choice.Get("index").Int()
+		text := choice.Get("text").String()
+		if chat {
+			text = choice.Get("message.content").String()
+			chunks = append(chunks, chunk([]any{map[string]any{
+				"index":         index,
+				"delta":         map[string]any{"role": choice.Get("message.role").String(), "content": ""},
+				"finish_reason": nil,
+			}}))
+		}
+
+		// Keep the whitespace so the concatenated deltas equal the original text
+		words := strings.SplitAfter(text, " ")
+		for i := 0; i < len(words); i += wordsPerChunk {
+			piece := strings.Join(words[i:min(i+wordsPerChunk, len(words))], "")
+			if piece == "" {
+				continue
+			}
+			var c map[string]any
+			if chat {
+				c = map[string]any{"index": index, "delta": map[string]any{"content": piece}, "finish_reason": nil}
+			} else {
+				c = map[string]any{"index": index, "text": piece, "finish_reason": nil, "logprobs": nil}
+			}
+			chunks = append(chunks, chunk([]any{c}))
+		}
+
+		last := map[string]any{"index": index, "finish_reason": choice.Get("finish_reason").String()}
+		if chat {
+			last["delta"] = map[string]any{}
+		} else {
+			last["text"] = ""
+		}
+		chunks = append(chunks, chunk([]any{last}))
+		return true
+	})
+
+	if includeUsage && payload.Get("usage").Exists() {
+		c := make(map[string]any, len(base)+2)
+		for k, v := range base {
+			c[k] = v
+		}
+		c["choices"] = []any{}
+		c["usage"] = json.RawMessage(payload.Get("usage").Raw)
+		b, _ := json.Marshal(c)
+		chunks = append(chunks, b)
+	}
+	return chunks, len(chunks) > 0
+}
+
+// Time to produce a stream of n chunks
+func (s streamSettings) duration(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	ms := s.FirstChunkMs
+	for i := 1; i < n; i++ {
+		ms += rand.ExpFloat64() * s.ChunkIntervalMs
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// Render the payload templates on the first chunk and copy the rendered values to the
+// other chunks, so all chunks of a replay share for example the same id. Placeholders in
+// the chunks themselves are only rendered for templated recordings
+func templateChunks(chunks []json.RawMessage, templates map[string]string, data []byte, templated bool) []json.RawMessage {
+	if len(chunks) == 0 {
+		return chunks
+	}
+	render := func(chunk json.RawMessage) json.RawMessage {
+		if templated {
+			return renderTemplate(chunk, data, false)
+		}
+		return chunk
+	}
+	rendered := make([]json.RawMessage, len(chunks))
+	rendered[0] = applyTemplates(render(chunks[0]), templates, data, false)
+	first := gjson.ParseBytes(rendered[0])
+	for i := 1; i < len(chunks); i++ {
+		chunk := string(chunks[i])
+		for path := range templates {
+			if !gjson.Get(chunk, path).Exists() {
+				continue
+			}
+			if updated, err := sjson.SetRaw(chunk, path, first.Get(path).Raw); err == nil {
+				chunk = updated
+			}
+		}
+		rendered[i] = render(json.RawMessage(chunk))
+	}
+	return rendered
+}
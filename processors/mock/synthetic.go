@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Synthetic text modes
+const (
+	syntheticLorem = "lorem"
+	syntheticEcho  = "echo"
+)
+
+// Fabricate responses for mocked paths without a recording
+type syntheticSettings struct {
+	Enabled          bool   `json:"enabled"`
+	Mode             string `json:"mode"`               // lorem or echo
+	DefaultMaxTokens int    `json:"default_max_tokens"` // used when the request has no max_tokens
+	MaxTokens        int    `json:"max_tokens"`         // cap on the max_tokens of the request
+	Model            string `json:"model"`              // used when neither request nor path names a model
+}
+
+var loremWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor
+	incididunt ut labore et dolore magna aliqua ut enim ad minim veniam quis nostrud exercitation ullamco
+	laboris nisi ut aliquip ex ea commodo consequat duis aute irure dolor in reprehenderit in voluptate velit
+	esse cillum dolore eu fugiat nulla pariatur excepteur sint occaecat cupidatat non proident sunt in culpa
+	qui officia deserunt mollit anim id est laborum`)
+
+// Build the gecholog fields for a synthetic response to the mocked path. The provider
+// shape is picked from the path and the request payload
+func syntheticResponse(mockedPath string, ingressPayload gjson.Result) map[string]json.RawMessage {
+
+	maxTokens := int(ingressPayload.Get("max_tokens").Int())
+	if maxTokens <= 0 {
+		maxTokens = int(ingressPayload.Get("max_completion_tokens").Int())
+	}
+	if maxTokens <= 0 {
+		maxTokens = config.synthetic.DefaultMaxTokens
+	}
+	// The request sets the size of the response, keep it bounded
+	maxTokens = min(maxTokens, config.synthetic.MaxTokens)
+
+	prompt := promptText(ingressPayload)
+	promptTokens := len(strings.Fields(prompt))
+
+	// One word per token
+	var completion []string
+	finishReason := "stop"
+	switch config.synthetic.Mode {
+	case syntheticEcho:
+		completion = strings.Fields(lastUserText(ingressPayload))
+		if len(completion) > maxTokens {
+			completion = completion[:maxTokens]
+			finishReason = "length"
+		}
+	default:
+		completion = make([]string, maxTokens)
+		for i := range completion {
+			completion[i] = loremWords[i%len(loremWords)]
+		}
+		finishReason = "length"
+	}
+	text := strings.Join(completion, " ")
+	completionTokens := len(completion)
+
+	model := ingressPayload.Get("model").String()
+	if model == "" {
+		model = deploymentFromPath(mockedPath)
+	}
+	if model == "" {
+		model = config.synthetic.Model
+	}
+
+	created := time.Now().Unix()
+	var payload any
+	switch {
+	case strings.Contains(mockedPath, "/embeddings"):
+		embedding := make([]float64, 8)
+		for i := range embedding {
+			embedding[i] = rand.Float64()*2 - 1
+		}
+		payload = map[string]any{
+			"object": "list",
+			"model":  model,
+			"data": []any{
+				map[string]any{"object": "embedding", "index": 0, "embedding": embedding},
+			},
+			"usage": map[string]any{"prompt_tokens": promptTokens, "total_tokens": promptTokens},
+		}
+	case strings.Contains(mockedPath, "/messages") || ingressPayload.Get("anthropic_version").Exists():
+		stopReason := "end_turn"
+		if finishReason == "length" {
+			stopReason = "max_tokens"
+		}
+		payload = map[string]any{
+			"id":            "msg_" + randomID(24),
+			"type":          "message",
+			"role":          "assistant",
+			"model":         model,
+			"content":       []any{map[string]any{"type": "text", "text": text}},
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+			"usage":         map[string]any{"input_tokens": promptTokens, "output_tokens": completionTokens},
+		}
+	case strings.Contains(mockedPath, "/chat/completions") || ingressPayload.Get("messages").Exists():
+		payload = map[string]any{
+			"id":      "chatcmpl-" + randomID(29),
+			"object":  "chat.completion",
+			"created": created,
+			"model":   model,
+			"choices": []any{
+				map[string]any{
+					"index":         0,
+					"finish_reason": finishReason,
+					"message":       map[string]any{"role": "assistant", "content": text},
+				},
+			},
+			"usage": openAIUsage(promptTokens, completionTokens),
+		}
+	default:
+		payload = map[string]any{
+			"id":      "cmpl-" + randomID(29),
+			"object":  "text_completion",
+			"created": created,
+			"model":   model,
+			"choices": []any{
+				map[string]any{"index": 0, "finish_reason": finishReason, "text": text, "logprobs": nil},
+			},
+			"usage": openAIUsage(promptTokens, completionTokens),
+		}
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	headersBytes, _ := json.Marshal(map[string][]string{
+		"Content-Type": {"application/json"},
+	})
+
+	var gechologData = make(map[string]json.RawMessage, 3)
+	gechologData["egress_payload"] = payloadBytes
+	gechologData["egress_headers"] = headersBytes
+	gechologData["egress_status_code"] = json.RawMessage("200")
+	return gechologData
+}
+
+func openAIUsage(promptTokens, completionTokens int) map[string]int {
+	return map[string]int{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+}
+
+// All prompt text of the request: messages, system, prompt or input
+func promptText(ingressPayload gjson.Result) string {
+	var parts []string
+	parts = append(parts, contentText(ingressPayload.Get("system")))
+	ingressPayload.Get("messages").ForEach(func(_, message gjson.Result) bool {
+		parts = append(parts, contentText(message.Get("content")))
+		return true
+	})
+	parts = append(parts, contentText(ingressPayload.Get("prompt")))
+	parts = append(parts, contentText(ingressPayload.Get("input")))
+	return strings.Join(parts, " ")
+}
+
+// Text of the last user message, or the prompt for completion style requests
+func lastUserText(ingressPayload gjson.Result) string {
+	text := ""
+	ingressPayload.Get("messages").ForEach(func(_, message gjson.Result) bool {
+		if message.Get("role").String() == "user" {
+			text = contentText(message.Get("content"))
+		}
+		return true
+	})
+	if text == "" {
+		text = contentText(ingressPayload.Get("prompt"))
+	}
+	return text
+}
+
+// Text of a content field. Handles plain strings, arrays of strings and arrays of content parts
+func contentText(content gjson.Result) string {
+	if !content.IsArray() {
+		if content.Type == gjson.String {
+			return content.String()
+		}
+		return ""
+	}
+	var parts []string
+	content.ForEach(func(_, part gjson.Result) bool {
+		if part.Type == gjson.String {
+			parts = append(parts, part.String())
+		} else if t := part.Get("text"); t.Exists() {
+			parts = append(parts, t.String())
+		}
+		return true
+	})
+	return strings.Join(parts, " ")
+}
+
+// Azure OpenAI paths name the deployment: /openai/deployments/{deployment}/...
+func deploymentFromPath(mockedPath string) string {
+	segments := strings.Split(mockedPath, "/")
+	for i, segment := range segments {
+		if segment == "deployments" && i+1 < len(segments) {
+			return segments[i+1]
+		}
+	}
+	return ""
+}
+
+func randomID(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return string(b)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Templates to apply on replay. Keys are gjson/sjson paths, values are template strings
+type templateSettings struct {
+	Payload map[string]string `json:"payload"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Longest id rendered by {{id N}}
+const maxIDLength = 256
+
+// Placeholders look like {{name arg1 arg2}}
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*([a-z_]+)((?:\s+[^\s{}]+)*)\s*\}\}`)
+
+// A placeholder that is a complete json string, like "{{unix}}", is replaced by the raw json value
+var wholeValueRegexp = regexp.MustCompile(`"\{\{\s*[a-z_]+(?:\s+[^\s{}"]+)*\s*\}\}"`)
+
+// Render a placeholder to a raw json value
+func renderPlaceholder(name string, args []string, data []byte) (string, error) {
+
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+	intArg := func(i int, fallback int) int {
+		if i < len(args) {
+			if n, err := strconv.Atoi(args[i]); err == nil {
+				return n
+			}
+		}
+		return fallback
+	}
+
+	switch name {
+	case "id", "random_id":
+		n := intArg(0, 29)
+		if n <= 0 || n > maxIDLength {
+			return "", fmt.Errorf("id length %d is not between 1 and %d", n, maxIDLength)
+		}
+		return quote(randomID(n)), nil
+	case "uuid":
+		b := make([]byte, 16)
+		for i := range b {
+			b[i] = byte(rand.IntN(256))
+		}
+		b[6] = (b[6] & 0x0f) | 0x40 // version 4
+		b[8] = (b[8] & 0x3f) | 0x80 // variant
+		return quote(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])), nil
+	case "unix":
+		return strconv.FormatInt(time.Now().Unix(), 10), nil
+	case "unix_ms":
+		return strconv.FormatInt(time.Now().UnixMilli(), 10), nil
+	case "now":
+		return quote(time.Now().UTC().Format(time.RFC3339)), nil
+	case "randint":
+		min, max := intArg(0, 0), intArg(1, 100)
+		if max < min {
+			return "", fmt.Errorf("randint max < min")
+		}
+		// The span does not fit in an int for wide ranges, the sum wraps back into [min, max]
+		span := uint64(max) - uint64(min)
+		if span == math.MaxUint64 {
+			return strconv.Itoa(int(rand.Uint64())), nil
+		}
+		return strconv.Itoa(min + int(rand.Uint64N(span+1))), nil
+	case "request":
+		if len(args) != 1 {
+			return "", fmt.Errorf("request needs one gjson path")
+		}
+		value := gjson.GetBytes(data, "ingress_payload").Get(args[0])
+		if !value.Exists() {
+			return "null", nil
+		}
+		return value.Raw, nil
+	case "header":
+		if len(args) != 1 {
+			return "", fmt.Errorf("header needs one header name")
+		}
+		return quote(headerValue(data, args[0])), nil
+	}
+	return "", fmt.Errorf("unknown placeholder %q", name)
+}
+
+// Render all placeholders in a raw json document. data is the incoming gecholog message
+// used to echo request fields. Headers keep all values as strings
+func renderTemplate(raw json.RawMessage, data []byte, headers bool) json.RawMessage {
+
+	if !strings.Contains(string(raw), "{{") {
+		return raw
+	}
+
+	render := func(placeholder string) (string, bool) {
+		parts := placeholderRegexp.FindStringSubmatch(placeholder)
+		if parts == nil {
+			return "", false
+		}
+		value, err := renderPlaceholder(parts[1], strings.Fields(parts[2]), data)
+		if err != nil {
+			slog.Warn("template error", slog.String("placeholder", placeholder), slog.Any("error", err))
+			return "", false
+		}
+		return value, true
+	}
+
+	// Whole json string values become raw json values
+	rendered := string(raw)
+	if !headers {
+		rendered = wholeValueRegexp.ReplaceAllStringFunc(rendered, func(quoted string) string {
+			if value, ok := render(quoted[1 : len(quoted)-1]); ok {
+				return value
+			}
+			return quoted
+		})
+	}
+
+	// Placeholders inside longer strings are inserted as escaped text
+	rendered = placeholderRegexp.ReplaceAllStringFunc(rendered, func(placeholder string) string {
+		value, ok := render(placeholder)
+		if !ok {
+			return placeholder
+		}
+		text := gjson.Parse(value).String()
+		escaped, _ := json.Marshal(text)
+		return string(escaped[1 : len(escaped)-1])
+	})
+
+	if !json.Valid([]byte(rendered)) {
+		slog.Warn("template produced invalid json, using the recording as is")
+		return raw
+	}
+	return json.RawMessage(rendered)
+}
+
+// Render the configured templates and set them on a payload or headers document. Payload paths
+// are only set if the recording has them, headers are always set. Header values are wrapped in an array
+func applyTemplates(raw json.RawMessage, templates map[string]string, data []byte, headers bool) json.RawMessage {
+	document := string(raw)
+	for path, template := range templates {
+		if !headers && !gjson.Get(document, path).Exists() {
+			continue
+		}
+		var value any = template
+		if headers {
+			value = []string{template}
+		}
+		quoted, _ := json.Marshal(value)
+		updated, err := sjson.SetRaw(document, path, string(renderTemplate(quoted, data, headers)))
+		if err != nil {
+			slog.Warn("template path error", slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+		document = updated
+	}
+	return json.RawMessage(document)
+}
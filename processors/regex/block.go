@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// Rule actions
+const (
+	actionAnnotate = "annotate" // Report the matches
+	actionRedact   = "redact"   // Replace the matches in the field
+	actionBlock    = "block"    // Stop the call when the regex matches
+)
+
+// Error type in the block body, used to find blocked requests in response context
+const blockType = "regex_blocked"
+
+// Error body sent to the client instead of the LLM API response
+type blockError struct {
+	Message    string `json:"message"`
+	Type       string `json:"type"`
+	Rule       string `json:"rule"`
+	StatusCode int    `json:"status_code"`
+}
+
+type blockResponse struct {
+	Error blockError `json:"error"`
+}
+
+func validateBlock(rule field) error {
+	if rule.blockStatusCode < 400 || rule.blockStatusCode > 599 {
+		return fmt.Errorf("block_status_code %d is not an error status code", rule.blockStatusCode)
+	}
+	return nil
+}
+
+// The error body for a call blocked by the rule
+func (rule field) blockBody() json.RawMessage {
+	message := rule.blockMessage
+	if message == "" {
+		message = "blocked by regex rule " + rule.name
+		if rule.name == "" {
+			message = "blocked by regex"
+		}
+	}
+	body, _ := json.Marshal(blockResponse{Error: blockError{
+		Message:    message,
+		Type:       blockType,
+		Rule:       rule.name,
+		StatusCode: rule.blockStatusCode,
+	}})
+	return body
+}
+
+// In response context, the status code of a call blocked in request context. 0 if it was not blocked.
+// gecholog returns the control field as egress_payload without calling the LLM API
+func blockedStatusCode(data []byte) int {
+	egressPayload := gjson.GetBytes(data, "egress_payload")
+	if egressPayload.Get("error.type").String() != blockType {
+		return 0
+	}
+	return int(egressPayload.Get("error.status_code").Int())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+// Bounds on the work for one message. Limits of 0 mean no limit
+type limits struct {
+	maxInputBytes int           // Only the first bytes of a field are matched
+	maxMatches    int           // Matches per rule
+	deadline      time.Duration // Rules not started before the deadline are skipped
+}
+
+// No limits, for the redact and block rules
+var noLimits = limits{}
+
+// The budget of one message
+type budget struct {
+	limits
+	started time.Time
+}
+
+func newBudget(l limits) *budget {
+	return &budget{limits: l, started: time.Now()}
+}
+
+// True when the deadline has passed
+func (b *budget) expired() bool {
+	return b.deadline > 0 && time.Since(b.started) > b.deadline
+}
+
+// Cut the text to the max input bytes, at a rune boundary
+func (b *budget) input(text string) (string, bool) {
+	if b.maxInputBytes <= 0 || len(text) <= b.maxInputBytes {
+		return text, false
+	}
+	end := b.maxInputBytes
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end], true
+}
+
+// Find the matches, at most the remaining matches of the rule
+func (b *budget) matches(re *regexp.Regexp, text string, found int) ([][]int, bool) {
+	if b.maxMatches <= 0 {
+		return re.FindAllStringSubmatchIndex(text, -1), false
+	}
+	remaining := b.maxMatches - found
+	if remaining <= 0 {
+		return nil, re.MatchString(text)
+	}
+	// One extra match tells if there were more
+	matches := re.FindAllStringSubmatchIndex(text, remaining+1)
+	if len(matches) > remaining {
+		return matches[:remaining], true
+	}
+	return matches, false
+}
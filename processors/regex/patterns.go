@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Pattern file format. Keys are routers (gl_path) or "default"
+type patternFile struct {
+	Patterns        map[string]patternEntry `json:"patterns" yaml:"patterns"`                 // Response context
+	RequestPatterns map[string]patternEntry `json:"request_patterns" yaml:"request_patterns"` // Request context
+}
+
+// A router has either a single field and regex, or a list of named rules
+type patternEntry struct {
+	patternRule `yaml:",inline"`
+	Rules       []patternRule `json:"rules" yaml:"rules"`
+}
+
+type patternRule struct {
+	Name              string `json:"name" yaml:"name"`
+	Field             string `json:"field" yaml:"field"` // gjson path in the gecholog message
+	Regex             string `json:"regex" yaml:"regex"`
+	Output            string `json:"output" yaml:"output"`                           // key in the output, defaults to name
+	Schema            any    `json:"schema" yaml:"schema"`                           // JSON Schema the extracted json must satisfy
+	InvalidStatusCode int    `json:"invalid_status_code" yaml:"invalid_status_code"` // egress_status_code when the schema is not satisfied
+
+	Action       string  `json:"action" yaml:"action"`                 // annotate (default), redact or block
+	Replace      *string `json:"replace" yaml:"replace"`               // rewrite template, supports $1 and ${name}
+	Mask         string  `json:"mask" yaml:"mask"`                     // rewrite every character of the match with this
+	MaskKeepLast int     `json:"mask_keep_last" yaml:"mask_keep_last"` // characters left unmasked at the end of the match
+
+	BlockStatusCode int    `json:"block_status_code" yaml:"block_status_code"` // defaults to 403
+	BlockMessage    string `json:"block_message" yaml:"block_message"`
+}
+
+// Read and validate a pattern file. .yaml and .yml files are read as yaml, all others as json.
+// Returns the response and the request context patterns
+func loadPatterns(path string) (map[string][]field, map[string][]field, error) {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file patternFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(fileBytes, &file)
+	default:
+		err = json.Unmarshal(fileBytes, &file)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if len(file.Patterns) == 0 && len(file.RequestPatterns) == 0 {
+		return nil, nil, fmt.Errorf("no patterns in %s", path)
+	}
+
+	patterns, err := buildPatterns(file.Patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestPatterns, err := buildPatterns(file.RequestPatterns)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request_patterns: %w", err)
+	}
+	return patterns, requestPatterns, nil
+}
+
+// Turn the file entries into compiled rules
+func buildPatterns(entries map[string]patternEntry) (map[string][]field, error) {
+	patterns := make(map[string][]field, len(entries))
+	for router, entry := range entries {
+		if len(entry.Rules) > 0 && (entry.Field != "" || entry.Regex != "") {
+			return nil, fmt.Errorf("router %s: use either field and regex or rules", router)
+		}
+		if len(entry.Rules) == 0 {
+			entry.Rules = []patternRule{entry.patternRule}
+		}
+
+		rules := make([]field, 0, len(entry.Rules))
+		for _, rule := range entry.Rules {
+			if err := validGjsonPath(rule.Field); err != nil {
+				return nil, fmt.Errorf("router %s: rule %q: field %q: %w", router, rule.Name, rule.Field, err)
+			}
+			newRule := field{
+				name:              rule.Name,
+				output:            rule.Output,
+				gjsonField:        rule.Field,
+				regex:             rule.Regex,
+				invalidStatusCode: rule.InvalidStatusCode,
+				action:            rule.Action,
+				blockStatusCode:   rule.BlockStatusCode,
+				blockMessage:      rule.BlockMessage,
+				replace:           rule.Replace,
+				mask:              rule.Mask,
+				maskKeepLast:      rule.MaskKeepLast,
+			}
+			if rule.Schema != nil {
+				schema, err := json.Marshal(rule.Schema)
+				if err != nil {
+					return nil, fmt.Errorf("router %s: rule %q: schema: %w", router, rule.Name, err)
+				}
+				newRule.schemaJSON = schema
+			}
+			rules = append(rules, newRule)
+		}
+		patterns[router] = rules
+	}
+	if err := compilePatterns(patterns); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// Basic gjson path syntax check: https://github.com/tidwall/gjson/blob/master/SYNTAX.md
+func validGjsonPath(path string) error {
+	if strings.TrimSpace(path) == "" {
+		return fmt.Errorf("empty path")
+	}
+
+	var stack []rune
+	escaped := false
+	previous := rune(0)
+	for i, r := range path {
+		if escaped {
+			escaped = false
+			previous = 'x'
+			continue
+		}
+		switch r {
+		case '\\':
+			escaped = true
+		case '.', '|':
+			if len(stack) == 0 && (i == 0 || previous == '.' || previous == '|') {
+				return fmt.Errorf("empty path component at %d", i)
+			}
+		case '(', '[', '{':
+			stack = append(stack, r)
+		case ')', ']', '}':
+			open := map[rune]rune{')': '(', ']': '[', '}': '{'}[r]
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("unbalanced %q at %d", r, i)
+			}
+			stack = stack[:len(stack)-1]
+		}
+		previous = r
+	}
+	if escaped {
+		return fmt.Errorf("trailing escape")
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %q", stack[len(stack)-1])
+	}
+	if previous == '.' || previous == '|' {
+		return fmt.Errorf("path ends with %q", previous)
+	}
+	return nil
+}
+
+// Swap in the patterns from the file. The old patterns are kept if the file is invalid
+func reloadPatterns(path string) {
+	patterns, requestPatterns, err := loadPatterns(path)
+	if err != nil {
+		slog.Error("error reloading patterns, keeping the current patterns", slog.String("file", path), slog.Any("error", err))
+		return
+	}
+	config.m.Lock()
+	config.patterns = patterns
+	config.requestPatterns = requestPatterns
+	config.m.Unlock()
+	slog.Info("patterns reloaded", slog.String("file", path), slog.Int("routers", len(patterns)), slog.Int("request_routers", len(requestPatterns)))
+}
+
+// Reload the pattern file when it changes or on SIGHUP
+func watchPatterns(ctx context.Context, path string, interval time.Duration) {
+
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	lastModTime := modTime()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("SIGHUP received")
+			lastModTime = modTime()
+			reloadPatterns(path)
+		case <-ticker.C:
+			if m := modTime(); !m.IsZero() && !m.Equal(lastModTime) {
+				lastModTime = m
+				reloadPatterns(path)
+			}
+		}
+	}
+}
@@ -3,62 +3,225 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
 type configuration struct {
-	matchJSON bool
+	matchJSON  bool
+	repairJSON bool // Fix common LLM json defects before parsing
 
 	natsServer  string
 	natsToken   string
 	natsSubject string
-	patterns    map[string]field
+	patterns    map[string][]field // Response context, extract from egress_payload
+
+	patternsFile   string        // Optional json/yaml file replacing the patterns below
+	reloadInterval time.Duration // How often to check the patterns file for changes
+
+	outputTarget string // payload, field or both
+	outputPath   string // sjson path in egress_payload
+	outputField  string // Top-level gecholog field, logged but not returned to the client
+
+	limits limits // Bounds on the work per message
+
+	requestPatterns    map[string][]field // Request context, extract from ingress_payload
+	requestOutputField string             // Request field written in request context
+
+	m *sync.RWMutex
 }
 
+// An extraction rule. A router with a single unnamed rule keeps the original output format
 type field struct {
+	name       string // Rule name, results are grouped by name
+	output     string // Key of the rule results in the output, defaults to name
 	gjsonField string
 	regex      string
+	re         *regexp.Regexp // Compiled once when the patterns are loaded
+
+	schemaJSON        json.RawMessage    // Optional JSON Schema for the extracted json
+	schema            *jsonschema.Schema // Compiled with the regex
+	invalidStatusCode int                // egress_status_code when the schema is not satisfied, 0 keeps the status code
+
+	action       string  // annotate, redact or block
+	replace      *string // Rewrite template with $1 and ${name}
+	mask         string  // Rewrite each character of the match with mask
+	maskKeepLast int
+
+	blockStatusCode int    // Status code returned when the rule blocks
+	blockMessage    string // Error message returned when the rule blocks
+}
+
+// Compile all regexes so messages never compile or fail on a bad pattern
+func compilePatterns(patterns map[string][]field) error {
+	for router, rules := range patterns {
+		outputs := make(map[string]bool, len(rules))
+		for i, rule := range rules {
+			if len(rules) > 1 && rule.name == "" {
+				return fmt.Errorf("router %s: rule %d has no name", router, i)
+			}
+			if rule.output == "" {
+				rule.output = rule.name
+			}
+			if outputs[rule.output] {
+				return fmt.Errorf("router %s: output %q used by more than one rule", router, rule.output)
+			}
+			outputs[rule.output] = true
+
+			re, err := regexp.Compile(rule.regex)
+			if err != nil {
+				return fmt.Errorf("router %s: rule %q: invalid regex %q: %w", router, rule.name, rule.regex, err)
+			}
+			rule.re = re
+
+			switch rule.action {
+			case "":
+				rule.action = actionAnnotate
+			case actionAnnotate:
+			case actionRedact:
+				if err := validateRewrite(rule); err != nil {
+					return fmt.Errorf("router %s: rule %q: %w", router, rule.name, err)
+				}
+			case actionBlock:
+				if rule.blockStatusCode == 0 {
+					rule.blockStatusCode = 403
+				}
+				if err := validateBlock(rule); err != nil {
+					return fmt.Errorf("router %s: rule %q: %w", router, rule.name, err)
+				}
+			default:
+				return fmt.Errorf("router %s: rule %q: unknown action %q", router, rule.name, rule.action)
+			}
+
+			if rule.schemaJSON != nil {
+				schema, err := compileSchema(rule.schemaJSON)
+				if err != nil {
+					return fmt.Errorf("router %s: rule %q: invalid schema: %w", router, rule.name, err)
+				}
+				rule.schema = schema
+			}
+			if rule.invalidStatusCode != 0 && (rule.invalidStatusCode < 100 || rule.invalidStatusCode > 599) {
+				return fmt.Errorf("router %s: rule %q: invalid status code %d", router, rule.name, rule.invalidStatusCode)
+			}
+			if rule.invalidStatusCode != 0 && rule.schema == nil {
+				return fmt.Errorf("router %s: rule %q: invalid_status_code needs a schema", router, rule.name)
+			}
+			rules[i] = rule
+		}
+	}
+	return nil
+}
+
+// Where the results are written
+const (
+	outputPayload = "payload" // Inside egress_payload, returned to the client
+	outputField   = "field"   // Separate gecholog field, only logged
+	outputBoth    = "both"
+)
+
+// Check the output settings, the fields can not replace a gecholog field the processor reads.
+// The output field is checked for all targets since blocked responses always use it
+func validateOutput(target, path, field, requestField string) error {
+	switch target {
+	case outputPayload, outputField, outputBoth:
+	default:
+		return fmt.Errorf("unknown output target %q", target)
+	}
+	if target != outputField && strings.TrimSpace(path) == "" {
+		return fmt.Errorf("empty output path")
+	}
+	reserved := func(field string) bool {
+		switch field {
+		case "", "gl_path", "ingress_subpath", "egress_payload", "ingress_payload":
+			return true
+		}
+		return false
+	}
+	if reserved(field) {
+		return fmt.Errorf("invalid output field %q", field)
+	}
+	if reserved(requestField) {
+		return fmt.Errorf("invalid request output field %q", requestField)
+	}
+	return nil
 }
 
 var config configuration = configuration{
-	natsSubject: "coburn.gl.regex",
-	matchJSON:   true,
-	patterns: map[string]field{
-		"default": field{
+	natsSubject:        "coburn.gl.regex",
+	matchJSON:          true,
+	reloadInterval:     5 * time.Second,
+	outputTarget:       outputPayload,
+	outputPath:         "regex",
+	outputField:        "regex",
+	requestOutputField: "regex_request",
+	requestPatterns:    map[string][]field{},
+	m:                  &sync.RWMutex{},
+	limits: limits{
+		maxInputBytes: 1 << 20,
+		maxMatches:    1000,
+		deadline:      80 * time.Millisecond, // gecholog waits 100 ms in gl_config.json
+	},
+	patterns: map[string][]field{
+		"default": []field{{
 			// https://github.com/tidwall/gjson/blob/master/SYNTAX.md
-			gjsonField: "egress_payload.choices.0.message.content",
+			gjsonField: "egress_payload.choices.#.message.content",
 			regex:      "```(?:md|markdown)\\n([\\s\\S]*?)\\n```",
-		},
-		"/markdown/": field{
+		}},
+		"/markdown/": []field{{
 			// https://github.com/tidwall/gjson/blob/master/SYNTAX.md
-			gjsonField: "egress_payload.choices.0.message.content",
+			gjsonField: "egress_payload.choices.#.message.content",
 			regex:      "```(?:md|markdown)\\n([\\s\\S]*?)\\n```",
-		},
-		"/json/": field{
+		}},
+		"/json/": []field{{
 			// https://github.com/tidwall/gjson/blob/master/SYNTAX.md
-			gjsonField: "egress_payload.choices.0.message.content",
+			gjsonField: "egress_payload.choices.#.message.content",
 			regex:      "```json\\n([\\s\\S]*?)\\n```",
-		},
+		}},
 	},
 }
 
 // Response message structure from the processor
 type section struct {
-	Text   string          `json:"text"`
-	Object json.RawMessage `json:"object"`
+	Text      string            `json:"text"`               // First capture group, or the full match if the regex has no groups
+	Object    json.RawMessage   `json:"object"`             // Text as json when MATCH_JSON is set
+	Repaired  bool              `json:"repaired,omitempty"` // Object is a repaired version of Text
+	FullMatch string            `json:"full_match"`         // Text matched by the whole regex
+	Groups    []string          `json:"groups"`             // All capture groups in order, empty string for groups that did not participate
+	Named     map[string]string `json:"named,omitempty"`
+	Index     []int             `json:"index,omitempty"` // Array indexes of the element for fields with #, like [choice, tool call]
+	Start     int               `json:"start"`           // Byte offsets of the full match in the field, or in the element
+	End       int               `json:"end"`
+	Valid     *bool             `json:"valid,omitempty"`         // Set when the rule has a schema
+	Errors    []string          `json:"schema_errors,omitempty"` // Schema validation errors
 }
 
 type regexpResponse struct {
-	Match    bool      `json:"match"`
-	Sections []section `json:"sections"`
+	Match        bool      `json:"match"`
+	Truncated    bool      `json:"truncated,omitempty"`    // A limit was reached, the result is partial
+	Replacements int       `json:"replacements,omitempty"` // Rewritten matches of a redact rule
+	Valid        *bool     `json:"valid,omitempty"`        // All sections satisfy the schema, false without sections
+	Sections     []section `json:"sections"`
+}
+
+// Response for routers with named rules, results grouped by rule
+type rulesResponse struct {
+	Match     bool                      `json:"match"`
+	Truncated bool                      `json:"truncated,omitempty"` // A rule was truncated or skipped
+	Valid     *bool                     `json:"valid,omitempty"`     // All rules with a schema are valid
+	Rules     map[string]regexpResponse `json:"rules"`
 }
 
 // ------------------------------- DO --------------------------------
@@ -102,74 +265,340 @@ func do(ctx context.Context, cancel context.CancelFunc) {
 				slog.Debug("sending back", slog.String("response", string(responseBytes)))
 			}()
 
-			// Figure out what router (gl_path) we are using
-			glPathExtract := gjson.Get(string(msg.Data), "gl_path")
-			glPath := glPathExtract.String()
-			if glPath == "" {
-				slog.Error("gl_path not found")
-				return
-			}
+			responseBytes = process(msg.Data)
+		},
+	)
+	if err != nil {
+		slog.Error("error subscribing to subject", slog.Any("error", err))
+		cancel()
+		return
+	}
+	defer sub.Unsubscribe()
 
-			_, exists := config.patterns[string(glPath)]
-			if !exists {
-				// Use default if it exists
-				if _, exists := config.patterns["default"]; !exists {
-					slog.Debug("noop: gl_path not found")
-					return
-				}
-				glPath = "default"
+	// Wait for messages
+	slog.Info("Connected to NATS server!")
+	<-ctx.Done()
+}
+
+// ------------------------------- PROCESS --------------------------------
+
+// Run one rule on the field it extracts from
+func applyRule(rule field, data []byte, b *budget) regexpResponse {
+
+	names := rule.re.SubexpNames()
+	ruleResponse := regexpResponse{Sections: []section{}}
+
+	// Extract the messages, one per array element for # queries
+	for _, element := range extractElements(rule.gjsonField, data) {
+		if b.expired() {
+			ruleResponse.Truncated = true
+			break
+		}
+		message, cut := b.input(element.text)
+		matches, more := b.matches(rule.re, message, len(ruleResponse.Sections))
+		ruleResponse.Truncated = ruleResponse.Truncated || cut || more
+		for _, match := range matches {
+			ruleResponse.Sections = append(ruleResponse.Sections, buildSection(rule, names, message, match, element.index))
+		}
+	}
+	ruleResponse.Match = len(ruleResponse.Sections) > 0
+
+	if rule.schema != nil {
+		valid := len(ruleResponse.Sections) > 0
+		for _, s := range ruleResponse.Sections {
+			valid = valid && *s.Valid
+		}
+		ruleResponse.Valid = &valid
+	}
+	return ruleResponse
+}
+
+// A text to match and where it is in the gjson array result
+type element struct {
+	index []int
+	text  string
+}
+
+// Extract the field. Each # in the path walks all elements of an array, the elements
+// get the index of each array they are in. Paths without # give one element without index
+func extractElements(gjsonField string, data []byte) []element {
+	if hashComponent(gjsonField) < 0 {
+		return []element{{text: gjson.GetBytes(data, gjsonField).String()}}
+	}
+	elements := []element{}
+	walkElements(string(data), gjsonField, []int{}, &elements)
+	return elements
+}
+
+// Walk the arrays ourselves, gjson leaves out elements without the path and the indexes would shift
+func walkElements(raw string, path string, index []int, elements *[]element) {
+	i := hashComponent(path)
+	if i < 0 {
+		result := gjson.Get(raw, path)
+		if result.Exists() && result.Type != gjson.Null {
+			*elements = append(*elements, element{index: index, text: result.String()})
+		}
+		return
+	}
+
+	array := gjson.Parse(raw)
+	if i > 0 {
+		array = gjson.Get(raw, path[:i-1])
+	}
+	if !array.IsArray() {
+		return
+	}
+	for n, item := range array.Array() {
+		walkElements(item.Raw, path[i+2:], append(slices.Clone(index), n), elements)
+	}
+}
+
+// Position of the first # path component followed by more path, -1 if there is none
+func hashComponent(path string) int {
+	for i := 0; i < len(path)-1; i++ {
+		if path[i] == '#' && path[i+1] == '.' && (i == 0 || path[i-1] == '.') {
+			return i
+		}
+	}
+	return -1
+}
+
+// Build the section of one match
+func buildSection(rule field, names []string, message string, match []int, index []int) section {
+	newSection := section{
+		Index:     index,
+		FullMatch: message[match[0]:match[1]],
+		Groups:    make([]string, 0, len(names)-1),
+		Start:     match[0],
+		End:       match[1],
+	}
+	for i := 1; i < len(names); i++ {
+		group := ""
+		if match[2*i] >= 0 {
+			group = message[match[2*i]:match[2*i+1]]
+		}
+		newSection.Groups = append(newSection.Groups, group)
+		if names[i] != "" {
+			if newSection.Named == nil {
+				newSection.Named = make(map[string]string)
 			}
+			newSection.Named[names[i]] = group
+		}
+	}
+
+	// Zero groups extract the full match
+	text := newSection.FullMatch
+	if len(newSection.Groups) > 0 {
+		text = newSection.Groups[0]
+	}
+	newSection.Text = text
+
+	// Repair LLM json defects, the raw text is kept if it can not be repaired
+	jsonText := text
+	if config.repairJSON && (config.matchJSON || rule.schema != nil) && !json.Valid([]byte(text)) {
+		if repaired, ok := repairJSON(text); ok {
+			jsonText = repaired
+			newSection.Repaired = true
+		}
+	}
 
-			// Extract the message
-			extractMessage := gjson.Get(string(msg.Data), config.patterns[string(glPath)].gjsonField)
-			message := extractMessage.String()
+	// If matchJSON is true, try to add it as a json object
+	if config.matchJSON && json.Valid([]byte(jsonText)) {
+		newSection.Object = json.RawMessage(jsonText)
+	}
+	// Validate against the schema of the rule
+	if rule.schema != nil {
+		newSection.Errors = validateSchema(rule.schema, []byte(jsonText))
+		valid := len(newSection.Errors) == 0
+		newSection.Valid = &valid
+	}
+	slog.Debug("newSection", slog.String("rule", rule.name), slog.Any("newSection", newSection))
+	return newSection
+}
 
-			re := regexp.MustCompile(config.patterns[string(glPath)].regex)
-			matches := re.FindAllStringSubmatch(message, -1)
+func boolOrder(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
 
-			processorResponse := regexpResponse{Sections: []section{}}
-			for _, match := range matches {
-				processorResponse.Match = true
-				text := match[1]
-				newSection := section{Text: text}
+// Extract the sections from a gecholog message and return the response to send back
+func process(data []byte) []byte {
 
-				// If matchJSON is true, try to add it as a json object
-				if config.matchJSON && json.Valid([]byte(text)) {
-					newSection.Object = json.RawMessage(text)
-				}
-				processorResponse.Sections = append(processorResponse.Sections, newSection)
-				slog.Debug("newSection", slog.Any("newSection", newSection))
+	// Figure out what router (gl_path) we are using
+	glPathExtract := gjson.Get(string(data), "gl_path")
+	glPath := glPathExtract.String()
+	if glPath == "" {
+		slog.Error("gl_path not found")
+		return []byte{}
+	}
+
+	// Check if the message is in a response/request context. If ingress_subpath exists => Context Request
+	requestContext := gjson.GetBytes(data, "ingress_subpath").Exists()
+
+	// A call blocked in request context only needs its status code
+	if !requestContext {
+		if statusCode := blockedStatusCode(data); statusCode != 0 {
+			slog.Debug("blocked in request context", slog.Int("egress_status_code", statusCode))
+			return []byte(fmt.Sprintf(`{"egress_status_code":%d}`, statusCode))
+		}
+	}
+
+	// Patterns can be reloaded at any time, use the current ones for this message
+	config.m.RLock()
+	patterns := config.patterns
+	if requestContext {
+		patterns = config.requestPatterns
+	}
+	rules, exists := patterns[string(glPath)]
+	if !exists {
+		// Use default if it exists
+		rules, exists = patterns["default"]
+	}
+	config.m.RUnlock()
+	if !exists || len(rules) == 0 {
+		slog.Debug("noop: gl_path not found")
+		return []byte{}
+	}
+
+	// Redact rules run first, in order, so the other rules never report the text they mask
+	rules = slices.Clone(rules)
+	slices.SortStableFunc(rules, func(a, b field) int {
+		return boolOrder(b.action == actionRedact) - boolOrder(a.action == actionRedact)
+	})
+
+	rewritten := make(map[string]bool) // Top-level fields changed by rewrite rules
+	var blockedBy *field               // First block rule that matched
+	annotateBudget := newBudget(config.limits)
+	guardrailBudget := newBudget(noLimits) // Redact and block rules always run to completion, a limit must not let text through
+	runRule := func(rule field) regexpResponse {
+		b := guardrailBudget
+		if rule.action == actionAnnotate {
+			b = annotateBudget
+		}
+		if b.expired() {
+			slog.Warn("deadline reached, skipping rule", slog.String("rule", rule.name), slog.String("gl_path", glPath))
+			return regexpResponse{Truncated: true, Sections: []section{}}
+		}
+		if rule.action != actionRedact {
+			ruleResponse := applyRule(rule, data, b)
+			if rule.action == actionBlock && ruleResponse.Match && blockedBy == nil {
+				blockedBy = &rule
 			}
+			return ruleResponse
+		}
+		newData, ruleResponse, err := rewriteRule(rule, data, b)
+		if err != nil {
+			slog.Error("problem rewriting field", slog.String("field", rule.gjsonField), slog.Any("error", err))
+			return ruleResponse
+		}
+		if ruleResponse.Replacements > 0 {
+			data = newData
+			rewritten[strings.SplitN(rule.gjsonField, ".", 2)[0]] = true
+		}
+		return ruleResponse
+	}
 
-			// Use sjson to update the egress_payload by adding the regex response
-			egressPayloadExtract := gjson.Get(string(msg.Data), "egress_payload")
-			newEgressPayload, err := sjson.Set(string(egressPayloadExtract.Raw), "regex", &processorResponse)
-			if err != nil {
-				slog.Error("problem setting regex field", slog.Any("error", err))
-				return
+	var processorResponse any
+	statusCode := 0 // Set when a rule with invalid_status_code fails its schema
+	if len(rules) == 1 && rules[0].name == "" {
+		ruleResponse := runRule(rules[0])
+		if ruleResponse.Valid != nil && !*ruleResponse.Valid {
+			statusCode = rules[0].invalidStatusCode
+		}
+		processorResponse = ruleResponse
+	} else {
+		grouped := rulesResponse{Rules: make(map[string]regexpResponse, len(rules))}
+		for _, rule := range rules {
+			ruleResponse := runRule(rule)
+			grouped.Match = grouped.Match || ruleResponse.Match
+			grouped.Truncated = grouped.Truncated || ruleResponse.Truncated
+			if ruleResponse.Valid != nil {
+				valid := *ruleResponse.Valid && (grouped.Valid == nil || *grouped.Valid)
+				grouped.Valid = &valid
+				if !*ruleResponse.Valid && statusCode == 0 {
+					statusCode = rule.invalidStatusCode
+				}
 			}
+			grouped.Rules[rule.output] = ruleResponse
+		}
+		processorResponse = grouped
+	}
 
-			var gechologData = make(map[string]json.RawMessage)
-			gechologData["egress_payload"] = json.RawMessage(newEgressPayload)
+	var gechologData = make(map[string]json.RawMessage)
 
-			// Prepare response
-			responseBytes, err = json.Marshal(&gechologData)
-			if err != nil {
-				slog.Error("error marshalling response", slog.Any("error", err))
-				return
-			}
-		},
-	)
-	if err != nil {
-		slog.Error("error subscribing to subject", slog.Any("error", err))
-		cancel()
-		return
+	// Return the fields changed by rewrite rules, unless the output below replaces them
+	for key := range rewritten {
+		gechologData[key] = json.RawMessage(gjson.GetBytes(data, key).Raw)
 	}
-	defer sub.Unsubscribe()
 
-	// Wait for messages
-	slog.Info("Connected to NATS server!")
-	<-ctx.Done()
+	// ------------------ REQUEST CONTEXT ------------------
+
+	if requestContext {
+		// ingress_payload is only changed by rewrite rules, the results go to a request field
+		responseField, err := json.Marshal(&processorResponse)
+		if err != nil {
+			slog.Error("error marshalling regex field", slog.Any("error", err))
+			return []byte{}
+		}
+		gechologData[config.requestOutputField] = json.RawMessage(responseField)
+
+		// control field means request will not be forwarded
+		// gecholog will write from control to inbound_payload and egress_payload
+		if blockedBy != nil {
+			slog.Info("blocking request", slog.String("rule", blockedBy.name), slog.String("gl_path", glPath))
+			gechologData["control"] = blockedBy.blockBody()
+		}
+
+		responseBytes, err := json.Marshal(&gechologData)
+		if err != nil {
+			slog.Error("error marshalling response", slog.Any("error", err))
+			return []byte{}
+		}
+		return responseBytes
+	}
+
+	// ------------------ RESPONSE CONTEXT ------------------
+
+	if blockedBy != nil {
+		// The client gets the error instead of the response, the results are logged in the output field below
+		slog.Info("blocking response", slog.String("rule", blockedBy.name), slog.String("gl_path", glPath))
+		gechologData["egress_payload"] = blockedBy.blockBody()
+		statusCode = blockedBy.blockStatusCode
+	} else if config.outputTarget != outputField {
+		// Use sjson to update the egress_payload by adding the regex response
+		egressPayloadExtract := gjson.Get(string(data), "egress_payload")
+		newEgressPayload, err := sjson.Set(string(egressPayloadExtract.Raw), config.outputPath, &processorResponse)
+		if err != nil {
+			slog.Error("problem setting regex field", slog.Any("error", err))
+			return []byte{}
+		}
+		gechologData["egress_payload"] = json.RawMessage(newEgressPayload)
+	}
+
+	if statusCode != 0 {
+		slog.Debug("setting status code", slog.Int("egress_status_code", statusCode))
+		gechologData["egress_status_code"] = json.RawMessage(fmt.Sprint(statusCode))
+	}
+
+	// Blocked responses always log the results, egress_payload no longer has them
+	if config.outputTarget != outputPayload || blockedBy != nil {
+		responseField, err := json.Marshal(&processorResponse)
+		if err != nil {
+			slog.Error("error marshalling regex field", slog.Any("error", err))
+			return []byte{}
+		}
+		gechologData[config.outputField] = json.RawMessage(responseField)
+	}
+
+	// Prepare response
+	responseBytes, err := json.Marshal(&gechologData)
+	if err != nil {
+		slog.Error("error marshalling response", slog.Any("error", err))
+		return []byte{}
+	}
+	return responseBytes
 }
 
 // ------------------------------- MAIN --------------------------------
@@ -190,11 +619,68 @@ func main() {
 	if os.Getenv("MATCH_JSON") != "" {
 		config.matchJSON = true
 	}
+	if os.Getenv("REPAIR_JSON") != "" {
+		config.repairJSON = true
+	}
+
+	if target := os.Getenv("OUTPUT_TARGET"); target != "" {
+		config.outputTarget = target
+	}
+	if path := os.Getenv("OUTPUT_PATH"); path != "" {
+		config.outputPath = path
+	}
+	if field := os.Getenv("OUTPUT_FIELD"); field != "" {
+		config.outputField = field
+	}
+	if maxInputBytes := os.Getenv("MAX_INPUT_BYTES"); maxInputBytes != "" {
+		config.limits.maxInputBytes, _ = strconv.Atoi(maxInputBytes)
+	}
+	if maxMatches := os.Getenv("MAX_MATCHES"); maxMatches != "" {
+		config.limits.maxMatches, _ = strconv.Atoi(maxMatches)
+	}
+	if deadline := os.Getenv("PROCESS_DEADLINE"); deadline != "" {
+		d, err := time.ParseDuration(deadline)
+		if err != nil {
+			slog.Error("invalid PROCESS_DEADLINE", slog.String("value", deadline), slog.Any("error", err))
+			return
+		}
+		config.limits.deadline = d
+	}
+
+	if field := os.Getenv("REQUEST_OUTPUT_FIELD"); field != "" {
+		config.requestOutputField = field
+	}
+	if err := validateOutput(config.outputTarget, config.outputPath, config.outputField, config.requestOutputField); err != nil {
+		slog.Error("error in output settings", slog.Any("error", err))
+		return
+	}
+
+	// Built-in patterns
+	if err := compilePatterns(config.patterns); err != nil {
+		slog.Error("error compiling patterns", slog.Any("error", err))
+		return
+	}
+
+	config.patternsFile = os.Getenv("PATTERNS_FILE")
+	if config.patternsFile != "" {
+		patterns, requestPatterns, err := loadPatterns(config.patternsFile)
+		if err != nil {
+			slog.Error("error loading patterns", slog.String("file", config.patternsFile), slog.Any("error", err))
+			return
+		}
+		config.patterns = patterns
+		config.requestPatterns = requestPatterns
+		slog.Info("patterns loaded", slog.String("file", config.patternsFile), slog.Int("routers", len(patterns)), slog.Int("request_routers", len(requestPatterns)))
+	}
 
 	// Create context & sync
 	ctx, cancelFunction := context.WithCancel(context.Background())
 	defer cancelFunction()
 
+	if config.patternsFile != "" {
+		go watchPatterns(ctx, config.patternsFile, config.reloadInterval)
+	}
+
 	go do(ctx, cancelFunction)
 
 	// wait for ctrl-C
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Fix the json defects LLMs commonly produce: comments, single quotes, unquoted keys,
+// Python literals, trailing commas, raw newlines in strings and truncated output.
+// Returns false if the text is not an object or array that can be turned into valid json
+func repairJSON(text string) (string, bool) {
+	if json.Valid([]byte(text)) {
+		return text, true
+	}
+	// Only objects and arrays, plain text should not become a json string
+	trimmed := strings.TrimLeft(text, " \t\r\n")
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return "", false
+	}
+
+	out := make([]byte, 0, len(text)+16)
+	var stack []byte // Open containers
+	var quote byte   // Quote of the open string, 0 outside strings
+
+	// Remove whitespace and dangling commas before a closing bracket or the end
+	trimTrailing := func() {
+		out = bytes.TrimRight(out, " \t\r\n")
+		for len(out) > 0 && out[len(out)-1] == ',' {
+			out = bytes.TrimRight(out[:len(out)-1], " \t\r\n")
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		// ------------------ INSIDE A STRING ------------------
+
+		if quote != 0 {
+			switch {
+			case c == '\\':
+				if i+1 >= len(text) {
+					continue // Truncated in an escape
+				}
+				i++
+				if text[i] == '\'' {
+					out = append(out, '\'') // \' is not a json escape
+				} else {
+					out = append(out, '\\', text[i])
+				}
+			case c == quote:
+				out = append(out, '"')
+				quote = 0
+			case c == '"':
+				out = append(out, '\\', '"')
+			case c == '\n':
+				out = append(out, '\\', 'n')
+			case c == '\r':
+				out = append(out, '\\', 'r')
+			case c == '\t':
+				out = append(out, '\\', 't')
+			default:
+				out = append(out, c)
+			}
+			continue
+		}
+
+		// ------------------ OUTSIDE STRINGS ------------------
+
+		switch {
+		case c == '/' && i+1 < len(text) && text[i+1] == '/', c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				i = len(text)
+			} else {
+				i += end + 3
+			}
+		case c == '"' || c == '\'':
+			out = append(out, '"')
+			quote = c
+		case c == '{' || c == '[':
+			out = append(out, c)
+			stack = append(stack, c)
+		case c == '}' || c == ']':
+			open := byte('{')
+			if c == ']' {
+				open = '['
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				continue // Unmatched closing bracket
+			}
+			trimTrailing()
+			out = append(out, c)
+			stack = stack[:len(stack)-1]
+		case isWordStart(c):
+			end := i
+			for end < len(text) && isWordPart(text[end]) {
+				end++
+			}
+			word := text[i:end]
+			i = end - 1
+			switch word {
+			case "true", "True", "TRUE":
+				out = append(out, "true"...)
+			case "false", "False", "FALSE":
+				out = append(out, "false"...)
+			case "null", "None", "NULL", "nil", "undefined", "NaN":
+				out = append(out, "null"...)
+			default:
+				// Unquoted key or bare word
+				quoted, _ := json.Marshal(word)
+				out = append(out, quoted...)
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+
+	// Close what the truncation left open
+	if quote != 0 {
+		out = append(out, '"')
+	}
+	trimTrailing()
+	out = trimNumber(out)
+	trimTrailing()
+	if len(out) > 0 && out[len(out)-1] == ':' {
+		out = append(out, "null"...)
+	}
+	closed := closeContainers(out, stack)
+	if json.Valid(closed) {
+		return string(closed), true
+	}
+
+	// Truncated after an object key
+	if len(stack) > 0 && stack[len(stack)-1] == '{' {
+		closed = closeContainers(append(out, ":null"...), stack)
+		if json.Valid(closed) {
+			return string(closed), true
+		}
+	}
+	return "", false
+}
+
+func closeContainers(out []byte, stack []byte) []byte {
+	closed := bytes.Clone(out)
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == '{' {
+			closed = append(closed, '}')
+		} else {
+			closed = append(closed, ']')
+		}
+	}
+	return closed
+}
+
+// Drop the incomplete end of a truncated number, like 1. or 2e-
+func trimNumber(out []byte) []byte {
+	start := len(out)
+	for start > 0 && bytes.IndexByte([]byte("0123456789.eE+-"), out[start-1]) >= 0 {
+		start--
+	}
+	if start == len(out) || (out[start] != '-' && (out[start] < '0' || out[start] > '9')) {
+		return out // Not a number, like true
+	}
+	return bytes.TrimRight(out, ".eE+-")
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isWordPart(c byte) bool {
+	return isWordStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Check the rewrite settings of a rule. The field is written back with sjson,
+// so it has to be a plain path without queries or modifiers
+func validateRewrite(rule field) error {
+	if rule.replace == nil && rule.mask == "" {
+		return fmt.Errorf("rewrite needs replace or mask")
+	}
+	if rule.replace != nil && rule.mask != "" {
+		return fmt.Errorf("use either replace or mask")
+	}
+	if rule.maskKeepLast < 0 {
+		return fmt.Errorf("mask_keep_last must not be negative")
+	}
+	if strings.ContainsAny(rule.gjsonField, "#@|*?()[]{}!=<>") {
+		return fmt.Errorf("rewrite field %q must be a plain path", rule.gjsonField)
+	}
+	if !strings.HasPrefix(rule.gjsonField, "egress_payload.") && !strings.HasPrefix(rule.gjsonField, "ingress_payload.") {
+		return fmt.Errorf("rewrite field %q must be in egress_payload or ingress_payload", rule.gjsonField)
+	}
+	return nil
+}
+
+// Mask a match, keeping the last characters if configured
+func (rule field) maskMatch(match string) string {
+	keep := min(rule.maskKeepLast, utf8.RuneCountInString(match))
+	masked := utf8.RuneCountInString(match) - keep
+	tail := match
+	for i := 0; i < masked; i++ {
+		_, size := utf8.DecodeRuneInString(tail)
+		tail = tail[size:]
+	}
+	return strings.Repeat(rule.mask, masked) + tail
+}
+
+// Replace the matches in the field of the rule. Returns the updated message and the number of replacements
+func rewriteRule(rule field, data []byte, b *budget) ([]byte, regexpResponse, error) {
+	ruleResponse := regexpResponse{Sections: []section{}}
+
+	extractMessage := gjson.GetBytes(data, rule.gjsonField)
+	if extractMessage.Type != gjson.String {
+		return data, ruleResponse, nil
+	}
+	message := extractMessage.String()
+
+	// process passes a budget without limits, a limit here would leave the rest of the field in clear text
+	searched, cut := b.input(message)
+	matches, more := b.matches(rule.re, searched, 0)
+	ruleResponse.Truncated = cut || more
+
+	var replaced []byte
+	last := 0
+	for _, match := range matches {
+		ruleResponse.Replacements++
+		replaced = append(replaced, message[last:match[0]]...)
+		if rule.replace == nil {
+			replaced = append(replaced, rule.maskMatch(message[match[0]:match[1]])...)
+		} else {
+			replaced = rule.re.ExpandString(replaced, *rule.replace, message, match)
+		}
+		last = match[1]
+	}
+	replaced = append(replaced, message[last:]...)
+	if ruleResponse.Replacements == 0 {
+		return data, ruleResponse, nil
+	}
+	ruleResponse.Match = true
+
+	newData, err := sjson.SetBytes(data, rule.gjsonField, string(replaced))
+	if err != nil {
+		return data, ruleResponse, err
+	}
+	return newData, ruleResponse, nil
+}
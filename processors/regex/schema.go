@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Compile the JSON Schema of a rule. The schema is given inline in the pattern file
+func compileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("schema.json")
+}
+
+// Validate an extracted json text. Returns the validation errors, empty if the text is valid
+func validateSchema(schema *jsonschema.Schema, text []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("invalid json: %v", err)}
+	}
+	if decoder.More() {
+		return []string{"invalid json: trailing data"}
+	}
+
+	err := schema.Validate(value)
+	if err == nil {
+		return []string{}
+	}
+	validationError, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	// Report the leaves, they hold the actual failures
+	errors := []string{}
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			location := ve.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			errors = append(errors, location+": "+ve.Message)
+			return
+		}
+		for _, cause := range ve.Causes {
+			leaves(cause)
+		}
+	}
+	leaves(validationError)
+	return errors
+}